@@ -18,121 +18,91 @@ import "fmt"
 import "connvitals/ping"
 import "connvitals/traceroute"
 import "connvitals/ports"
+import "connvitals/dns"
+import "connvitals/resolver"
 import "sync"
 import "github.com/pborman/getopt/v2"
 import "net"
 import "connvitals/utils"
 import "bytes"
 import "os"
+import "os/signal"
+import "syscall"
+import "context"
+import "time"
+import "strings"
 
 // Constants
-const IP4LEN = 4;
-const IP6LEN = 16;
 const SOFTWARE_VERSION = "3.0.0";
 
-//Holds results until the end of execution
-var pingResults map[*net.IPAddr]string = make(map[*net.IPAddr]string);
-var traceResults map[*net.IPAddr]string = make(map[*net.IPAddr]string);
-var scanResults map[*net.IPAddr]string = make(map[*net.IPAddr]string);
-
-// Concurrency locks
-var pinglock = sync.RWMutex{};
-var tracelock = sync.RWMutex{};
-var scanlock = sync.RWMutex{};
-
 /*
-	Thread-safe function to write a ping result to the results map.
+	A resolved target host, along with the name the user originally specified it with.
 */
-func writePingResult(host *net.IPAddr, res string) {
-	pinglock.Lock();
-	defer pinglock.Unlock();
-	pingResults[host] = res;
-}
+type target struct {
+	name string;
+	addr *net.IPAddr;
+	IPv6 bool;
+};
 
 /*
-	Thread-safe function to write a route trace result to the results map.
+	Bundles the flags that configure a single sampling cycle, so runCycle doesn't need a long,
+	ever-growing parameter list as new probes are added.
 */
-func writeRoute(host *net.IPAddr, res string) {
-	tracelock.Lock();
-	defer tracelock.Unlock();
-	traceResults[host] = res;
-}
+type cycleConfig struct {
+	MaxHops int;
+	NumPings int;
+	NoPings bool;
+	Trace bool;
+	JSON bool;
+	Payload int;
+	PortScan bool;
+	Probes []string;
+	DNSDiag bool;
+	Resolver string;
+	TrafficClass int;
+	TraceProbes int;
+};
 
 /*
-	Thread-safe function to write a ping result to the results map.
+	Thread-safe function to write a result string to a results map.
 */
-func writeScan(host *net.IPAddr, res string) {
-	scanlock.Lock();
-	defer scanlock.Unlock();
-	scanResults[host] = res;
+func writeResult(lock *sync.RWMutex, results map[*net.IPAddr]string, host *net.IPAddr, res string) {
+	lock.Lock();
+	defer lock.Unlock();
+	results[host] = res;
 }
 
-func main() {
-
-	MAX_HOPS := getopt.IntLong("hops", 'H', 30, "Sets max hops for route tracing (default 30).");
-	HELP := getopt.BoolLong("help", 'h', "Prints help text and exits.");
-	NUMPINGS := getopt.IntLong("pings", 'p', 10, "Sets the number of pings to use for aggregate statistics (default 10).");
-	NOPINGS := getopt.BoolLong("no-ping", 'P', "Don't run ping tests.");
-	TRACE := getopt.BoolLong("trace", 't', "Run route tracing.");
-	JSON := getopt.BoolLong("json", 'j', "Print output as one line of JSON formatted information.")
-	PAYLOAD := getopt.IntLong("payload-size", 0, 41, "Sets the size (in B) of ping packet payloads (default 41).");
-	PORTSCAN := getopt.BoolLong("port-scan", 's', "Perform a limited scan on each host's ports.")
-	VERSION := getopt.BoolLong("version", 'V', "Print the version information, then exit.")
-	getopt.Parse();
-
-	if *VERSION {
-		fmt.Printf("connvitals Version %s\n", SOFTWARE_VERSION);
-		os.Exit(0);
-	} else if *HELP {
-		getopt.Usage();
-		os.Exit(0);
-	}
-
-	args := getopt.Args();
-	if len(args) < 1 {
-		getopt.Usage();
-		os.Exit(1);
-	}
-
-
-	//Holds the original names of hosts, for easier identification in output
+/*
+	Runs a single sampling cycle against targets, printing each host's results when finished
+	(one line of JSON per host, or a block of plaintext lines per host, per cfg.JSON). ctx is threaded into every probe so that
+	a cancellation drains in-flight goroutines instead of leaving them to run to completion.
+*/
+func runCycle(ctx context.Context, targets []target, cfg cycleConfig) {
+	// Holds results for just this cycle, so stale entries from previous cycles never leak in
 	hostnames := make(map[*net.IPAddr]string);
+	pingResults := make(map[*net.IPAddr]string);
+	traceResults := make(map[*net.IPAddr]string);
+	scanResults := make(map[*net.IPAddr]string);
+	dnsResults := make(map[*net.IPAddr]string);
+
+	var pinglock, tracelock, scanlock, dnslock sync.RWMutex;
 
 	// Multiprocessing worker pool
 	var pool sync.WaitGroup;
 
-	for arg := range args {
-
-		// Parse the host for an IP Address
-		var host string = args[arg];
-		targetIP, err := net.ResolveIPAddr("ip", host);
-		if err != nil {
-			utils.Error(utils.GenericError{"Host '"+host+"' could not be resolved"}, 0);
-			continue;
-		}
-
-
-		// Determine if IP is ipv4 or ipv6
-		var IPv6 bool;
-		if len(targetIP.IP.To4()) == IP4LEN {
-			IPv6 = false;
-		} else if len(targetIP.IP) == IP6LEN {
-			IPv6 = true;
-		} else {
-			utils.Error(utils.GenericError{"Host '"+host+"' could not be resolved"}, 0);
-			continue;
-		}
+	for _, t := range targets {
+		targetIP := t.addr;
+		IPv6 := t.IPv6;
+		host := t.name;
 
-
-		//Store the user-specified name of this host
 		hostnames[targetIP] = host;
 
 		// Asynchronously ping this host
-		if ! *NOPINGS {
+		if ! cfg.NoPings {
 			pool.Add(1);
 			go func () {
 				defer pool.Done();
-				min, avg, max, std, loss, err := ping.PingHost(targetIP, IPv6, *NUMPINGS, *PAYLOAD);
+				min, avg, max, std, loss, err := ping.PingHost(ctx, targetIP, IPv6, cfg.NumPings, cfg.Payload);
 				if err != nil {
 					utils.Error(err, 0);
 				}
@@ -140,7 +110,7 @@ func main() {
 				var format string;
 
 				// create json-ified text if necessary...
-				if *JSON {
+				if cfg.JSON {
 					format = "{\"min\":%f,\"avg\":%f,\"max\":%f,\"std\":%f,\"loss\":%f}";
 
 				// ...otherwise just format the results
@@ -148,16 +118,16 @@ func main() {
 					format = "%.3f\t%.3f\t%.3f\t%.3f\t%.3f";
 				}
 
-				writePingResult(targetIP, fmt.Sprintf(format, min, avg, max, std, loss));
+				writeResult(&pinglock, pingResults, targetIP, fmt.Sprintf(format, min, avg, max, std, loss));
 			}();
 		}
 
 
-		if *TRACE {
+		if cfg.Trace {
 			pool.Add(1);
 			go func() {
 				defer pool.Done();
-				tracer, err := traceroute.New(targetIP, *MAX_HOPS, IPv6);
+				tracer, err := traceroute.New(ctx, targetIP, cfg.MaxHops, IPv6, cfg.TrafficClass, cfg.TraceProbes);
 				if err != nil {
 					utils.Error(err, 0);
 					return;
@@ -167,11 +137,14 @@ func main() {
 				if err != nil {
 					utils.Error(err, 0);
 				}
+				if len(result) < 1 {
+					return;
+				}
 
 				var buffer bytes.Buffer;
 
 				// create json-ified text if necessary...
-				if *JSON {
+				if cfg.JSON {
 					buffer.WriteRune('[');
 					buffer.WriteString(result[0].JSON());
 					for step := range result[1:] {
@@ -189,60 +162,190 @@ func main() {
 					}
 				}
 
-				writeRoute(targetIP, buffer.String());
+				writeResult(&tracelock, traceResults, targetIP, buffer.String());
 			}();
 		}
 
-		if *PORTSCAN {
+		if cfg.PortScan {
 			pool.Add(1);
 			go func () {
 				defer pool.Done();
-				httpScanResult, httpsScanResult, mysqlScanResult := ports.Scan(targetIP.String(), IPv6);
+				probeResults := ports.ScanProbes(ctx, targetIP.String(), IPv6, cfg.Probes, cfg.TrafficClass);
 
 				var buffer bytes.Buffer;
+				var wrote bool;
 
-				// create json-ified text if necessary...
-				if *JSON {
-					buffer.WriteString("{\"http\":");
-					buffer.WriteString(httpScanResult.JSON());
-					buffer.WriteString(",\"https\":");
-					buffer.WriteString(httpsScanResult.JSON());
-					buffer.WriteString(",\"mysql\":");
-					buffer.WriteString(mysqlScanResult.JSON());
-					buffer.WriteRune('}');
+				for _, res := range probeResults {
+					if res.Result == nil {
+						utils.Warn("unknown port-scan probe '"+res.Name+"'");
+						continue;
+					}
 
-				// ...otherwise just format the results
+					if cfg.JSON {
+						if wrote {
+							buffer.WriteRune(',');
+						}
+						buffer.WriteRune('"');
+						buffer.WriteString(res.Name);
+						buffer.WriteString("\":");
+						buffer.WriteString(res.Result.JSON());
+					} else {
+						if wrote {
+							buffer.WriteRune('\t');
+						}
+						buffer.WriteString(res.Result.String());
+					}
+					wrote = true;
+				}
+
+				if cfg.JSON {
+					var out bytes.Buffer;
+					out.WriteRune('{');
+					out.Write(buffer.Bytes());
+					out.WriteRune('}');
+					writeResult(&scanlock, scanResults, targetIP, out.String());
 				} else {
-					buffer.WriteString(httpScanResult.String());
-					buffer.WriteRune('\t');
-					buffer.WriteString(httpsScanResult.String());
-					buffer.WriteRune('\t');
-					buffer.WriteString(mysqlScanResult.String());
+					writeResult(&scanlock, scanResults, targetIP, buffer.String());
 				}
-				writeScan(targetIP, buffer.String());
+			}();
+		}
+
+		if cfg.DNSDiag {
+			pool.Add(1);
+			go func () {
+				defer pool.Done();
+				result, err := dns.Query(ctx, host, cfg.Resolver, cfg.NumPings);
+				if err != nil {
+					utils.Error(err, 0);
+					return;
+				}
+
+				var out string;
+				if cfg.JSON {
+					out = result.JSON();
+				} else {
+					out = result.String();
+				}
+				writeResult(&dnslock, dnsResults, targetIP, out);
 			}();
 		}
 	}
 
 	pool.Wait();
 
-	utils.Print(*JSON, hostnames, pingResults, traceResults, scanResults);
-
-	// // Print results
-	// for key, value := range hostnames {
-	// 	if key.String() == value {
-	// 		fmt.Println(key.String());
-	// 	} else {
-	// 		fmt.Printf("%s (%s)\n", value, key.String());
-	// 	}
-	// 	if ! *NOPINGS && len(pingResults[key]) > 0 {
-	// 		fmt.Print(pingResults[key]);
-	// 	}
-	// 	if *TRACE && len(traceResults[key]) > 0 {
-	// 		fmt.Print(traceResults[key]);
-	// 	}
-	// 	if *PORTSCAN && len(scanResults[key]) > 0 {
-	// 		fmt.Println(scanResults[key]);
-	// 	}
-	// }
+	utils.Print(cfg.JSON, hostnames, pingResults, traceResults, scanResults, dnsResults);
+}
+
+/*
+	Resolves each of hostnames using resolve, logging (but not failing on) any that can't be
+	resolved. This is the only seam that talks to a Resolver; ping/traceroute/ports are handed
+	the already-resolved *net.IPAddr from the returned targets and have no DNS concerns of
+	their own, so they take no Resolver of their own.
+*/
+func resolveTargets(resolve resolver.Resolver, hostnames []string) []target {
+	targets := make([]target, 0, len(hostnames));
+	for _, host := range hostnames {
+		addr, IPv6, err := resolve.Lookup(host);
+		if err != nil {
+			utils.Error(utils.GenericError{"Host '"+host+"' could not be resolved"}, 0);
+			continue;
+		}
+		targets = append(targets, target{host, addr, IPv6});
+	}
+	return targets;
+}
+
+func main() {
+
+	MAX_HOPS := getopt.IntLong("hops", 'H', 30, "Sets max hops for route tracing (default 30).");
+	HELP := getopt.BoolLong("help", 'h', "Prints help text and exits.");
+	NUMPINGS := getopt.IntLong("pings", 'p', 10, "Sets the number of pings to use for aggregate statistics (default 10).");
+	NOPINGS := getopt.BoolLong("no-ping", 'P', "Don't run ping tests.");
+	TRACE := getopt.BoolLong("trace", 't', "Run route tracing.");
+	JSON := getopt.BoolLong("json", 'j', "Print output as one line of JSON formatted information.")
+	PAYLOAD := getopt.IntLong("payload-size", 0, 41, "Sets the size (in B) of ping packet payloads (default 41).");
+	PORTSCAN := getopt.BoolLong("port-scan", 's', "Perform a limited scan on each host's ports.")
+	PROBES := getopt.StringLong("probe", 0, "http,https,mysql", "Comma-separated list of port-scan probes to run, each optionally suffixed with \":port\" to override its default port (e.g. \"http:8080,https:8443,ssh\"); default \"http,https,mysql\"; built-in probes are http, https, mysql, ssh, tls, dns, smtp.")
+	DNSDIAG := getopt.BoolLong("dns", 'd', "Run DNS diagnostics (record retrieval, resolver RTT, TCP-vs-UDP comparison) against each host.")
+	RESOLVER := getopt.StringLong("resolver", 0, "1.1.1.1:53", "Sets the resolver (host:port) used for DNS diagnostics.")
+	TOS := getopt.IntLong("tos", 0, 0, "Sets the IPv4 TOS / IPv6 Traffic Class byte (e.g. DSCP) marked on outgoing traceroute and port-scan probes (default 0, i.e. best-effort).")
+	TRACEPROBES := getopt.IntLong("trace-probes", 'q', 3, "Sets the number of probes sent per hop during route tracing (default 3, like traceroute's -q).")
+	INTERVAL := getopt.StringLong("interval", 'i', "0s", "Sets the interval between sampling cycles, e.g. \"30s\" (default 0s, meaning run once and exit).")
+	COUNT := getopt.IntLong("count", 'c', 1, "Sets the number of sampling cycles to run (default 1; 0 means run forever).")
+	VERSION := getopt.BoolLong("version", 'V', "Print the version information, then exit.")
+	getopt.Parse();
+
+	if *VERSION {
+		fmt.Printf("connvitals Version %s\n", SOFTWARE_VERSION);
+		os.Exit(0);
+	} else if *HELP {
+		getopt.Usage();
+		os.Exit(0);
+	}
+
+	args := getopt.Args();
+	if len(args) < 1 {
+		getopt.Usage();
+		os.Exit(1);
+	}
+
+	interval, err := time.ParseDuration(*INTERVAL);
+	if err != nil {
+		utils.Error(utils.GenericError{"Invalid --interval value '"+*INTERVAL+"': "+err.Error()}, 1);
+	}
+
+	cfg := cycleConfig{*MAX_HOPS, *NUMPINGS, *NOPINGS, *TRACE, *JSON, *PAYLOAD, *PORTSCAN, strings.Split(*PROBES, ","), *DNSDIAG, *RESOLVER, *TOS, *TRACEPROBES};
+
+	// Resolves hostnames to IP addresses, caching answers so a hostname given more than once is
+	// only resolved once; targets are resolved here and again only on SIGHUP, not every cycle
+	var resolve resolver.Resolver = resolver.NewCachingResolver();
+
+	var targetsLock sync.RWMutex;
+	targets := resolveTargets(resolve, args);
+
+	ctx, cancel := context.WithCancel(context.Background());
+	defer cancel();
+
+	sigs := make(chan os.Signal, 1);
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP);
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				// Re-resolve hostnames, picking up any DNS changes. A fresh resolver is used
+				// each time since CachingResolver never evicts or expires entries on its own.
+				resolve = resolver.NewCachingResolver();
+				resolved := resolveTargets(resolve, args);
+				targetsLock.Lock();
+				targets = resolved;
+				targetsLock.Unlock();
+				continue;
+			}
+
+			// SIGINT/SIGTERM: drain in-flight goroutines via ctx, then let main return
+			cancel();
+			return;
+		}
+	}();
+
+	for cycle := 0; *COUNT == 0 || cycle < *COUNT; cycle++ {
+		if ctx.Err() != nil {
+			break;
+		}
+
+		targetsLock.RLock();
+		current := targets;
+		targetsLock.RUnlock();
+
+		runCycle(ctx, current, cfg);
+
+		if interval <= 0 || (*COUNT != 0 && cycle == *COUNT-1) {
+			break;
+		}
+
+		select {
+			case <-ctx.Done():
+				return;
+			case <-time.After(interval):
+		}
+	}
 }
@@ -0,0 +1,45 @@
+package main
+
+// Copyright 2018 Comcast Cable Communications Management, LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import "net"
+import "testing"
+import "connvitals/resolver"
+
+/*
+	Exercises the seam where main actually talks to a Resolver - resolveTargets - against a
+	MockResolver instead of real DNS, confirming hosts resolve to the right address family and
+	that an unresolvable host is logged and skipped rather than aborting the run.
+*/
+func TestResolveTargetsWithMockResolver(t *testing.T) {
+	zone := map[string]net.IP{
+		"v4.example.com": net.ParseIP("192.0.2.1"),
+		"v6.example.com": net.ParseIP("2001:db8::1"),
+	};
+	mock := resolver.NewMockResolver(zone);
+
+	targets := resolveTargets(mock, []string{"v4.example.com", "v6.example.com", "missing.example.com"});
+
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 resolved targets (unresolvable host should be skipped), got %d", len(targets));
+	}
+
+	if targets[0].name != "v4.example.com" || targets[0].IPv6 {
+		t.Errorf("expected v4.example.com to resolve as IPv4, got %+v", targets[0]);
+	}
+	if targets[1].name != "v6.example.com" || !targets[1].IPv6 {
+		t.Errorf("expected v6.example.com to resolve as IPv6, got %+v", targets[1]);
+	}
+}
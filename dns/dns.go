@@ -0,0 +1,227 @@
+package dns
+
+// Copyright 2018 Comcast Cable Communications Management, LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import "github.com/miekg/dns"
+import "connvitals/utils"
+import "time"
+import "sync"
+import "math"
+import "fmt"
+import "context"
+
+// Record types queried for every host
+var queryTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMX, dns.TypeTXT, dns.TypeNS};
+
+/*
+	Issues a single query of type qtype for host against resolver over the given network
+	("udp" or "tcp"), and returns the list of answers rendered as strings, along with the
+	round-trip-time of the exchange. ctx, when cancelled, aborts the exchange promptly instead
+	of waiting out the full 2-second timeout.
+*/
+func query(ctx context.Context, host string, qtype uint16, resolver string, network string) (answers []string, rtt time.Duration, err error) {
+	msg := new(dns.Msg);
+	msg.SetQuestion(dns.Fqdn(host), qtype);
+	msg.RecursionDesired = true;
+
+	client := &dns.Client{Net: network, Timeout: 2 * time.Second};
+	resp, rtt, err := client.ExchangeContext(ctx, msg, resolver);
+	if err != nil {
+		return;
+	}
+
+	for _, ans := range resp.Answer {
+		switch qtype {
+			case dns.TypeA:
+				if a, ok := ans.(*dns.A); ok {
+					answers = append(answers, a.A.String());
+				}
+			case dns.TypeAAAA:
+				if aaaa, ok := ans.(*dns.AAAA); ok {
+					answers = append(answers, aaaa.AAAA.String());
+				}
+			case dns.TypeCNAME:
+				if cname, ok := ans.(*dns.CNAME); ok {
+					answers = append(answers, cname.Target);
+				}
+			case dns.TypeMX:
+				if mx, ok := ans.(*dns.MX); ok {
+					answers = append(answers, fmt.Sprintf("%d %s", mx.Preference, mx.Mx));
+				}
+			case dns.TypeTXT:
+				if txt, ok := ans.(*dns.TXT); ok {
+					for _, s := range txt.Txt {
+						answers = append(answers, s);
+					}
+				}
+			case dns.TypeNS:
+				if ns, ok := ans.(*dns.NS); ok {
+					answers = append(answers, ns.Ns);
+				}
+		}
+	}
+
+	return;
+}
+
+/*
+	Gathers A/AAAA/CNAME/MX/TXT/NS records for host by querying resolver once per record type.
+	ctx, when cancelled, aborts any still-outstanding queries.
+*/
+func records(ctx context.Context, host string, resolver string) (res utils.DNSResult, err error) {
+	var pool sync.WaitGroup;
+	var mtx sync.Mutex;
+	pool.Add(len(queryTypes));
+
+	for _, qtype := range queryTypes {
+		go func(qtype uint16) {
+			defer pool.Done();
+			answers, _, qerr := query(ctx, host, qtype, resolver, "udp");
+			if qerr != nil {
+				return; // Absence of a record type isn't fatal; just leave it empty
+			}
+
+			mtx.Lock();
+			defer mtx.Unlock();
+			switch qtype {
+				case dns.TypeA:
+					res.A = answers;
+				case dns.TypeAAAA:
+					res.AAAA = answers;
+				case dns.TypeCNAME:
+					res.CNAME = answers;
+				case dns.TypeMX:
+					res.MX = answers;
+				case dns.TypeTXT:
+					res.TXT = answers;
+				case dns.TypeNS:
+					res.NS = answers;
+			}
+		}(qtype);
+	}
+
+	pool.Wait();
+	return;
+}
+
+/*
+	Queries the resolver's "A" record for host numqueries times, and returns min/avg/max/std/loss
+	statistics (in milliseconds) over the round-trip-times of those queries, in the same style
+	as ping.PingHost. ctx, when cancelled, stops issuing further queries and counts the
+	remaining ones as lost instead of running them out sequentially.
+*/
+func resolverStats(ctx context.Context, host string, resolver string, numqueries int) (min, avg, max, std, loss float64) {
+	rtts := make([]float64, numqueries);
+	lost := 0;
+
+	for i := 0; i < numqueries; i++ {
+		if ctx.Err() != nil {
+			rtts[i] = -1;
+			lost++;
+			continue;
+		}
+
+		_, rtt, err := query(ctx, host, dns.TypeA, resolver, "udp");
+		if err != nil {
+			rtts[i] = -1;
+			lost++;
+			continue;
+		}
+		rtts[i] = float64(rtt) / float64(time.Millisecond);
+	}
+
+	if lost >= numqueries {
+		return -1, -1, -1, -1, 100;
+	}
+
+	min = math.Inf(0);
+	for _, rtt := range rtts {
+		if rtt < 0 {
+			continue;
+		}
+		if rtt < min {
+			min = rtt;
+		}
+		if rtt > max {
+			max = rtt;
+		}
+		avg += rtt;
+	}
+	avg /= float64(numqueries - lost);
+
+	for _, rtt := range rtts {
+		if rtt >= 0 {
+			std += math.Pow(rtt-avg, 2);
+		}
+	}
+	if numqueries-lost > 1 {
+		std = math.Sqrt(std / float64(numqueries-1-lost));
+	} else {
+		std = 0;
+	}
+
+	loss = float64(lost) / float64(numqueries) * 100.0;
+	return;
+}
+
+/*
+	Compares the RTT of a UDP exchange against a TCP exchange for the host's "A" record,
+	returning -1 for either leg that fails. ctx, when cancelled, aborts both exchanges promptly.
+*/
+func tcpVsUDP(ctx context.Context, host string, resolver string) (tcpRTT, udpRTT float64) {
+	var pool sync.WaitGroup;
+	pool.Add(2);
+
+	go func() {
+		defer pool.Done();
+		_, rtt, err := query(ctx, host, dns.TypeA, resolver, "udp");
+		if err != nil {
+			udpRTT = -1;
+			return;
+		}
+		udpRTT = float64(rtt) / float64(time.Millisecond);
+	}();
+
+	go func() {
+		defer pool.Done();
+		_, rtt, err := query(ctx, host, dns.TypeA, resolver, "tcp");
+		if err != nil {
+			tcpRTT = -1;
+			return;
+		}
+		tcpRTT = float64(rtt) / float64(time.Millisecond);
+	}();
+
+	pool.Wait();
+	return;
+}
+
+/*
+	Runs DNS diagnostics against host: retrieves A/AAAA/CNAME/MX/TXT/NS records, resolver RTT
+	statistics over numqueries exchanges, and a TCP-vs-UDP timing comparison. All queries are
+	sent to resolver (e.g. "1.1.1.1:53"). ctx, when cancelled, aborts any still-outstanding
+	queries so callers draining on SIGINT/SIGTERM aren't stuck waiting out numqueries'
+	worth of sequential resolver timeouts.
+*/
+func Query(ctx context.Context, host string, resolver string, numqueries int) (result utils.DNSResult, err error) {
+	result, err = records(ctx, host, resolver);
+	if err != nil {
+		return;
+	}
+
+	result.Min, result.Avg, result.Max, result.Std, result.Loss = resolverStats(ctx, host, resolver, numqueries);
+	result.TCPRTT, result.UDPRTT = tcpVsUDP(ctx, host, resolver);
+	return;
+}
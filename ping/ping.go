@@ -18,14 +18,58 @@ import "net"
 import "golang.org/x/net/ipv4"
 import "golang.org/x/net/ipv6"
 import "golang.org/x/net/icmp"
+import "golang.org/x/net/bpf"
 import "time"
 import "sync"
 import "math"
+import "math/rand"
+import "context"
 import "connvitals/utils"
 
 const IPV6_NETWORK_STRING = "ip6:ipv6-icmp";
 const IPV4_NETWORK_STRING = "ip4:icmp"
 
+// Raw ICMP type values for echo replies, as untyped numbers for the BPF filter to compare against
+const ICMP4_ECHO_REPLY_TYPE = 0;
+const ICMP6_ECHO_REPLY_TYPE = 129;
+
+/*
+	Assembles a classic BPF program that matches only ICMP Echo Reply packets (type 0 for IPv4,
+	129 for IPv6) whose identifier field equals id, so the kernel can drop everything else before
+	it reaches ReadFrom. IPv4 raw sockets deliver the IP header along with the ICMP payload, so
+	the ICMP header's offset has to be computed from the IP header length (the low nibble of the
+	first byte); IPv6 raw sockets deliver the ICMPv6 header starting at offset 0.
+*/
+func buildEchoReplyFilter(IPv6 bool, id uint16) ([]bpf.RawInstruction, error) {
+	var typ uint32;
+	var insns []bpf.Instruction;
+
+	if IPv6 {
+		typ = ICMP6_ECHO_REPLY_TYPE;
+		insns = []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: typ, SkipTrue: 3},
+			bpf.LoadAbsolute{Off: 4, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(id), SkipTrue: 1},
+			bpf.RetConstant{Val: 0x40000},
+			bpf.RetConstant{Val: 0},
+		};
+	} else {
+		typ = ICMP4_ECHO_REPLY_TYPE;
+		insns = []bpf.Instruction{
+			bpf.LoadMemShift{Off: 0},
+			bpf.LoadIndirect{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: typ, SkipTrue: 3},
+			bpf.LoadIndirect{Off: 4, Size: 2},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(id), SkipTrue: 1},
+			bpf.RetConstant{Val: 0x40000},
+			bpf.RetConstant{Val: 0},
+		};
+	}
+
+	return bpf.Assemble(insns);
+}
+
 /*
 	A data structure that handles sending/receiving ICMP Echo ("ping") packets
 */
@@ -36,10 +80,16 @@ type Pinger struct {
 	Connection *icmp.PacketConn;
 	timestamps []time.Time;
 	RTTS []time.Duration;
+	ID int;
 };
 
 /*
-	Builds a Pinger object, initializing the connection and setting the rtts to -1
+	Builds a Pinger object, initializing the connection and setting the rtts to -1.
+	A random identifier is chosen for this Pinger's packets, to avoid cross-process collisions,
+	and a kernel-level BPF filter matching only echo replies bearing that identifier is installed
+	on the connection so the kernel drops unrelated ICMP traffic before it ever reaches Recv.
+	If the platform doesn't support SetBPF, filtering gracefully falls back to userspace, as it
+	was done before this Pinger installed any filter.
 */
 func New(host *net.IPAddr, IPv6 bool, payload int, numpings int) (pinger *Pinger, err error) {
 	initialrtts := make([]time.Duration, numpings);
@@ -54,6 +104,7 @@ func New(host *net.IPAddr, IPv6 bool, payload int, numpings int) (pinger *Pinger
 	             nil,
 	             make([]time.Time, numpings),
 	             initialrtts,
+	             rand.Intn(0xffff),
 	         };
 
 	if IPv6 {
@@ -70,6 +121,21 @@ func New(host *net.IPAddr, IPv6 bool, payload int, numpings int) (pinger *Pinger
 		pinger.Connection.IPv4PacketConn().SetDeadline(time.Now().Add(2 * time.Second));
 	}
 
+	filter, ferr := buildEchoReplyFilter(IPv6, uint16(pinger.ID));
+	if ferr != nil {
+		utils.Warn("failed to assemble BPF echo-reply filter, falling back to userspace filtering: " + ferr.Error());
+		return;
+	}
+
+	if IPv6 {
+		ferr = pinger.Connection.IPv6PacketConn().SetBPF(filter);
+	} else {
+		ferr = pinger.Connection.IPv4PacketConn().SetBPF(filter);
+	}
+	if ferr != nil {
+		utils.Warn("kernel doesn't support SetBPF on this platform, falling back to userspace filtering: " + ferr.Error());
+	}
+
 	return;
 }
 
@@ -88,7 +154,7 @@ func (pinger *Pinger) MkPacket(seqno int) (msg icmp.Message) {
 		Type: typ,
 		Code: 0,
 		Body: &icmp.Echo{
-			ID: 2,
+			ID: pinger.ID,
 			Seq: seqno,
 			Data: pinger.Payload,
 		},
@@ -150,7 +216,7 @@ func (pinger *Pinger) Recv() (err error) {
 			msg, err = icmp.ParseMessage(proto, buf[:size]);
 			if err != nil {
 				return;
-			} else if (msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply ) && msg.Body.(*icmp.Echo).ID == 2 {
+			} else if (msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply ) && msg.Body.(*icmp.Echo).ID == pinger.ID {
 				break;
 			}
 
@@ -168,14 +234,26 @@ func (pinger *Pinger) Recv() (err error) {
 
 /*
 	Pings a single host passed as an argument, and returns a result string that's ready for printing.
+	ctx, when cancelled, causes the Pinger's connection to be closed so any in-flight Recv calls
+	unblock and PingHost returns promptly instead of waiting out the full 2-second deadline.
 */
-func PingHost(host *net.IPAddr, IPv6 bool, numpings int, payload int) (min, avg, max, std, loss float64, err error) {
+func PingHost(ctx context.Context, host *net.IPAddr, IPv6 bool, numpings int, payload int) (min, avg, max, std, loss float64, err error) {
 	pinger, err := New(host, IPv6, payload, numpings);
 	if err != nil {
 		return;
 	}
 	defer pinger.Connection.Close();
 
+	done := make(chan struct{});
+	defer close(done);
+	go func() {
+		select {
+			case <-ctx.Done():
+				pinger.Connection.Close();
+			case <-done:
+		}
+	}();
+
 	var pool sync.WaitGroup;
 
 	for i := 0; i < numpings; i++ {
@@ -0,0 +1,91 @@
+package ping
+
+// Copyright 2018 Comcast Cable Communications Management, LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import "encoding/binary"
+import "testing"
+import "golang.org/x/net/bpf"
+
+/*
+	Builds a raw IPv4 packet (20-byte header, IHL=5) carrying an ICMP header of the given type
+	and identifier, as the kernel would deliver it to a raw ICMP socket.
+*/
+func rawIPv4ICMPPacket(typ byte, id uint16) []byte {
+	pkt := make([]byte, 28);
+	pkt[0] = 0x45; // version 4, IHL 5 (20-byte header)
+	pkt[20] = typ;
+	binary.BigEndian.PutUint16(pkt[24:26], id);
+	return pkt;
+}
+
+/*
+	Builds a raw IPv6 ICMP packet (no IP header, as delivered to a raw ICMPv6 socket) of the
+	given type and identifier.
+*/
+func rawIPv6ICMPPacket(typ byte, id uint16) []byte {
+	pkt := make([]byte, 8);
+	pkt[0] = typ;
+	binary.BigEndian.PutUint16(pkt[4:6], id);
+	return pkt;
+}
+
+/*
+	Confirms the assembled BPF program accepts only echo replies matching both the expected
+	ICMP type and identifier, for both IPv4 and IPv6.
+*/
+func TestBuildEchoReplyFilter(t *testing.T) {
+	const id = 0xbeef;
+
+	cases := []struct {
+		name string;
+		IPv6 bool;
+		pkt []byte;
+		accept bool;
+	}{
+		{"ipv4 matching", false, rawIPv4ICMPPacket(ICMP4_ECHO_REPLY_TYPE, id), true},
+		{"ipv4 wrong type", false, rawIPv4ICMPPacket(8, id), false},
+		{"ipv4 wrong id", false, rawIPv4ICMPPacket(ICMP4_ECHO_REPLY_TYPE, id+1), false},
+		{"ipv6 matching", true, rawIPv6ICMPPacket(ICMP6_ECHO_REPLY_TYPE, id), true},
+		{"ipv6 wrong type", true, rawIPv6ICMPPacket(128, id), false},
+		{"ipv6 wrong id", true, rawIPv6ICMPPacket(ICMP6_ECHO_REPLY_TYPE, id+1), false},
+	};
+
+	for _, c := range cases {
+		raw, err := buildEchoReplyFilter(c.IPv6, id);
+		if err != nil {
+			t.Fatalf("%s: buildEchoReplyFilter returned an error: %s", c.name, err);
+		}
+
+		insns, ok := bpf.Disassemble(raw);
+		if !ok {
+			t.Fatalf("%s: failed to fully disassemble filter", c.name);
+		}
+
+		vm, err := bpf.NewVM(insns);
+		if err != nil {
+			t.Fatalf("%s: failed to build VM: %s", c.name, err);
+		}
+
+		n, err := vm.Run(c.pkt);
+		if err != nil {
+			t.Fatalf("%s: VM.Run returned an error: %s", c.name, err);
+		}
+
+		accepted := n > 0;
+		if accepted != c.accept {
+			t.Errorf("%s: expected accept=%v, got accept=%v (n=%d)", c.name, c.accept, accepted, n);
+		}
+	}
+}
@@ -15,153 +15,729 @@ package ports
 // limitations under the License.
 
 import "net"
-import "connvitals/utils"
 import "time"
 import "sync"
 import "crypto/tls"
 import "bytes"
-
-
+import "bufio"
+import "strings"
+import "strconv"
+import "encoding/binary"
+import "fmt"
+import "context"
+import "golang.org/x/net/ipv4"
+import "golang.org/x/net/ipv6"
+import "connvitals/utils"
 
 var request []byte = []byte("HEAD / HTTP/1.1\r\n\r\n");
 const ms = float64(time.Millisecond);
+
+/*
+	Marks conn with the IPv4 TOS or IPv6 Traffic Class byte tc, so probes can measure paths for
+	a specific DSCP class instead of only best-effort. A trafficClass of 0 is a no-op, so probes
+	behave exactly as before when the caller doesn't ask for a specific class.
+*/
+func markConn(conn net.Conn, IPv6 bool, trafficClass int) error {
+	if trafficClass == 0 {
+		return nil;
+	}
+	if IPv6 {
+		return ipv6.NewConn(conn).SetTrafficClass(trafficClass);
+	}
+	return ipv4.NewConn(conn).SetTOS(trafficClass);
+}
+
+////////////////////////////////////////////////////////
+//                 Plugin Machinery                   //
+////////////////////////////////////////////////////////
+
+/*
+	A type that a port-scan plugin's results must implement, so they can be printed through
+	the same JSON/plaintext machinery as every other result type in this tool.
+*/
+type Result interface {
+	JSON() string;
+	String() string;
+};
+
 /*
-	Attempts to connect to a host specified by "host" and return a result of the form:
+	A single named service probe. DefaultPort is the well-known port Probe dials when the user
+	doesn't override it on the CLI (e.g. "--probe http:8080"). Probe is given the bare host (no
+	port) and whether it's an IPv6 address, and is responsible for dialing port and reporting a
+	Result. ctx, when already cancelled, tells Probe not to bother dialing out.
+*/
+type Prober interface {
+	Name() string;
+	DefaultPort() int;
+	Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error);
+};
+
+// The set of registered probes, keyed by name, along with the order they were registered in
+// (so the default probe list is deterministic).
+var registry = make(map[string]Prober);
+var order []string;
+
+/*
+	Registers a Prober under its Name(), so it can subsequently be selected on the CLI with
+	--probe. Downstream users can call this from an init() function to compile in custom probes
+	without touching this package.
+*/
+func Register(p Prober) {
+	if _, exists := registry[p.Name()]; !exists {
+		order = append(order, p.Name());
+	}
+	registry[p.Name()] = p;
+}
+
+/*
+	Looks up a registered Prober by name.
+*/
+func Lookup(name string) (Prober, bool) {
+	p, found := registry[name];
+	return p, found;
+}
+
+/*
+	Returns the names of every registered Prober, in registration order.
+*/
+func Registered() []string {
+	names := make([]string, len(order));
+	copy(names, order);
+	return names;
+}
+
+func init() {
+	Register(httpProber{});
+	Register(httpsProber{});
+	Register(mysqlProber{});
+	Register(sshProber{});
+	Register(tlsProber{});
+	Register(dnsProber{});
+	Register(smtpProber{});
+}
+
+////////////////////////////////////////////////////////
+//                  HTTP / HTTPS                      //
+////////////////////////////////////////////////////////
+
+/*
+	The result of probing an HTTP(S) server: the RTT of the request, its response code, and the
+	contents of its "Server: " header, if present.
+*/
+type HTTPResult struct {
+	RTT float64;
+	Response string;
+	Server string;
+};
+
+func (res HTTPResult) JSON() string {
+	if res.RTT < 0 || (res.Response == "" && res.Server == "") {
+		return "\"None\"";
+	}
+	return fmt.Sprintf("{\"rtt\":%f,\"response code\":\"%s\",\"server\":\"%s\"}", res.RTT, res.Response, res.Server);
+}
+
+func (res HTTPResult) String() string {
+	if res.RTT < 0 || (res.Response == "" && res.Server == "") {
+		return "None";
+	}
+	return fmt.Sprintf("%.3f, %s, %s", res.RTT, res.Response, res.Server);
+}
+
+/*
+	Parses the "Server: " header out of a raw HTTP response buffer, or "Unkown" if absent.
+*/
+func parseServerHeader(buff []byte) string {
+	if srvHeader := bytes.Index(buff, []byte("Server: ")); srvHeader > 0 {
+		srvEnd := bytes.Index(buff[srvHeader+8:], []byte("\r\n"));
+		return string(buff[srvHeader+8 : srvHeader+8+srvEnd]);
+	}
+	return "Unkown";
+}
+
+/*
+	Attempts to connect to a host specified by "host" on port and return a result of the form:
 		Response Code, Server Info
 	where Response Code is the code of a response to a "HEAD / HTTP/1.1" request and
 	Server Info is the contents of the "Server: " header if present, or "Unkown" otherwise.
-	If anything goes wrong, it will instead return "None".
+	If anything goes wrong, it will instead return an HTTPResult with an RTT of -1.
 */
-func http(host string) utils.HttpScanResult {
+func httpProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) HTTPResult {
+	if ctx.Err() != nil {
+		return HTTPResult{-1, "", ""};
+	}
+
 	// Create socket
-	conn, err := net.DialTimeout("tcp", host+":http", 25 * time.Millisecond);
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 25 * time.Millisecond);
 	if err != nil {
-		return  utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
 	}
 	defer conn.Close();
 
+	if err = markConn(conn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on http probe: " + err.Error());
+	}
+
 	// Set timestamp
 	ts := time.Now();
 
 	// Set socket "timeout"
 	err = conn.SetDeadline(ts.Add(100 * time.Millisecond));
 	if err != nil {
-		return utils.HttpScanResult{-1, "", ""}; // I have no idea why this would happen, unless the fd gets closed for some reason
+		return HTTPResult{-1, "", ""}; // I have no idea why this would happen, unless the fd gets closed for some reason
 	}
 
 	// Immediately send request
 	_, err = conn.Write(request);
 	if err != nil {
-		return utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
 	}
 
 	buff := make([]byte, 1000);
 	_, err = conn.Read(buff);
 	if err != nil {
-		return utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
 	}
 
-	var srv string = "Unkown";
-	if srvHeader := bytes.Index(buff, []byte("Server: ")); srvHeader > 0 {
-		srvEnd := bytes.Index(buff[srvHeader+8:], []byte("\r\n"))
-		srv = string(buff[srvHeader+8:srvHeader+8+srvEnd]);
-	}
-
-	return utils.HttpScanResult{float64(time.Since(ts))/ms, string(buff[9:12]), srv};
-
+	return HTTPResult{float64(time.Since(ts))/ms, string(buff[9:12]), parseServerHeader(buff)};
 }
 
 /*
-	Attempts to connect via TLS to a host specified by "host" and return a result of the form:
+	Attempts to connect via TLS to a host specified by "host" on port and return a result of the
+	form:
 		Response Code, Server Info
 	where Response Code is the code of a response to a "HEAD / HTTP/1.1" request and
 	Server Info is the contents of the "Server: " header if present or "Unkown" otherwise.
-	If anything goes wrong, it will instead return "None".
+	If anything goes wrong, it will instead return an HTTPResult with an RTT of -1.
 */
-func https(host string) utils.HttpScanResult {
-	conn, err := tls.Dial("tcp", host+":https", &tls.Config{InsecureSkipVerify: true});
+func httpsProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) HTTPResult {
+	if ctx.Err() != nil {
+		return HTTPResult{-1, "", ""};
+	}
+
+	rawConn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 25 * time.Millisecond);
 	if err != nil {
-		return  utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
+	}
+
+	if err = markConn(rawConn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on https probe: " + err.Error());
 	}
 
+	conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true});
+	if err = conn.Handshake(); err != nil {
+		rawConn.Close();
+		return HTTPResult{-1, "", ""};
+	}
+	defer conn.Close();
+
 	ts := time.Now();
 	err = conn.SetDeadline(ts.Add(100 * time.Millisecond));
 	if err != nil {
-		return  utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
 	}
 
 	_, err = conn.Write(request);
 	if err != nil {
-		return  utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
 	}
 
 	buff := make([]byte, 1000);
 	_, err = conn.Read(buff);
 	if err != nil {
-		return  utils.HttpScanResult{-1, "", ""};
+		return HTTPResult{-1, "", ""};
 	}
 
-	var srv string = "Unkown";
-	if srvHeader := bytes.Index(buff, []byte("Server: ")); srvHeader > 0 {
-		srvEnd := bytes.Index(buff[srvHeader+8:], []byte("\r\n"))
-		srv = string(buff[srvHeader+8:srvHeader+8+srvEnd]);
+	return HTTPResult{float64(time.Since(ts))/ms, string(buff[9:12]), parseServerHeader(buff)};
+}
+
+type httpProber struct{};
+func (httpProber) Name() string { return "http"; }
+func (httpProber) DefaultPort() int { return 80; }
+func (httpProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
+	if IPv6 {
+		host = "["+host+"]";
 	}
+	return httpProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
 
-	return utils.HttpScanResult{float64(time.Since(ts))/ms, string(buff[9:12]), srv};
+type httpsProber struct{};
+func (httpsProber) Name() string { return "https"; }
+func (httpsProber) DefaultPort() int { return 443; }
+func (httpsProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
+	if IPv6 {
+		host = "["+host+"]";
+	}
+	return httpsProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
+
+////////////////////////////////////////////////////////
+//                      MySQL                         //
+////////////////////////////////////////////////////////
+
+/*
+	The result of probing a MySQL server: the RTT of the connection, and the version string
+	reported in its greeting packet.
+*/
+type MySQLResult struct {
+	RTT float64;
+	Version string;
+};
+
+func (res MySQLResult) JSON() string {
+	if res.RTT < 0 || res.Version == "" {
+		return "\"None\"";
+	}
+	return fmt.Sprintf("{\"rtt\":%f,\"version\":\"%s\"}", res.RTT, res.Version);
+}
+
+func (res MySQLResult) String() string {
+	if res.RTT < 0 || res.Version == "" {
+		return "None";
+	}
+	return fmt.Sprintf("%.3f, %s", res.RTT, res.Version);
 }
 
 /*
 	Attempts to connect to a host specified by "host" and return the version of a
-	MySQL server listening on port 3306 if one can be found. Will otherwise return
-	"None".
+	MySQL server listening on port if one can be found. Will otherwise return
+	a MySQLResult with an RTT of -1.
 */
-func mysql(host string) utils.MysqlScanResult {
-	conn, err := net.DialTimeout("tcp", host+":3306", 25 * time.Millisecond);
+func mysqlProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) MySQLResult {
+	if ctx.Err() != nil {
+		return MySQLResult{-1, ""};
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 25 * time.Millisecond);
 	if err != nil {
-		return utils.MysqlScanResult{-1, ""};
+		return MySQLResult{-1, ""};
+	}
+	defer conn.Close();
+
+	if err = markConn(conn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on mysql probe: " + err.Error());
 	}
 
 	ts := time.Now();
 	err = conn.SetDeadline(ts.Add(10 * time.Millisecond));
 	if err != nil {
-		return utils.MysqlScanResult{-1, ""};
+		return MySQLResult{-1, ""};
 	}
 
 	buff := make([]byte, 1000);
 	_, err = conn.Read(buff);
 	if err != nil {
-		return utils.MysqlScanResult{-1, ""};
+		return MySQLResult{-1, ""};
+	}
+
+	return MySQLResult{float64(time.Since(ts))/ms, string(buff[5:10])};
+}
+
+type mysqlProber struct{};
+func (mysqlProber) Name() string { return "mysql"; }
+func (mysqlProber) DefaultPort() int { return 3306; }
+func (mysqlProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
+	if IPv6 {
+		host = "["+host+"]";
+	}
+	return mysqlProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
+
+////////////////////////////////////////////////////////
+//                       SSH                          //
+////////////////////////////////////////////////////////
+
+/*
+	The result of probing an SSH server: the RTT of the connection, its identification banner,
+	and the kex_algorithms name-list advertised in its first KEXINIT packet.
+*/
+type SSHResult struct {
+	RTT float64;
+	Banner string;
+	KexAlgorithms string;
+};
+
+func (res SSHResult) JSON() string {
+	if res.RTT < 0 || res.Banner == "" {
+		return "\"None\"";
+	}
+	return fmt.Sprintf("{\"rtt\":%f,\"banner\":\"%s\",\"kex_algorithms\":\"%s\"}", res.RTT, res.Banner, res.KexAlgorithms);
+}
+
+func (res SSHResult) String() string {
+	if res.RTT < 0 || res.Banner == "" {
+		return "None";
+	}
+	return fmt.Sprintf("%.3f, %s, %s", res.RTT, res.Banner, res.KexAlgorithms);
+}
+
+// Offset (in the raw binary packet) of the first name-list within an SSH_MSG_KEXINIT payload:
+// 4 bytes packet_length + 1 byte padding_length + 1 byte message code + 16 bytes cookie.
+const sshKexInitNameListOffset = 4 + 1 + 1 + 16;
+const sshMsgKexInit = 20;
+
+/*
+	Connects to host on port, reads its identification banner, and makes a best-effort
+	attempt to pull the kex_algorithms name-list out of the KEXINIT packet that follows. If
+	anything goes wrong, it returns an SSHResult with an RTT of -1.
+*/
+func sshProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) SSHResult {
+	if ctx.Err() != nil {
+		return SSHResult{-1, "", ""};
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 500 * time.Millisecond);
+	if err != nil {
+		return SSHResult{-1, "", ""};
+	}
+	defer conn.Close();
+
+	if err = markConn(conn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on ssh probe: " + err.Error());
+	}
+
+	ts := time.Now();
+	err = conn.SetDeadline(ts.Add(500 * time.Millisecond));
+	if err != nil {
+		return SSHResult{-1, "", ""};
+	}
+
+	reader := bufio.NewReader(conn);
+	banner, err := reader.ReadString('\n');
+	if err != nil {
+		return SSHResult{-1, "", ""};
 	}
+	banner = strings.TrimRight(banner, "\r\n");
+	rtt := float64(time.Since(ts)) / ms;
 
-	return utils.MysqlScanResult{float64(time.Since(ts))/ms, string(buff[5:10])};
+	kex := "Unknown";
+	buff := make([]byte, 4096);
+	n, err := reader.Read(buff);
+	if err == nil && n > sshKexInitNameListOffset+4 && buff[5] == sshMsgKexInit {
+		listLen := int(binary.BigEndian.Uint32(buff[sshKexInitNameListOffset : sshKexInitNameListOffset+4]));
+		if sshKexInitNameListOffset+4+listLen <= n {
+			kex = string(buff[sshKexInitNameListOffset+4 : sshKexInitNameListOffset+4+listLen]);
+		}
+	}
+
+	return SSHResult{rtt, banner, kex};
+}
+
+type sshProber struct{};
+func (sshProber) Name() string { return "ssh"; }
+func (sshProber) DefaultPort() int { return 22; }
+func (sshProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
+	if IPv6 {
+		host = "["+host+"]";
+	}
+	return sshProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
+
+////////////////////////////////////////////////////////
+//                       TLS                          //
+////////////////////////////////////////////////////////
+
+/*
+	The result of probing a raw TLS listener: RTT of the TCP connect plus TLS handshake, negotiated protocol version and
+	cipher suite, and the leaf certificate's expiry.
+*/
+type TLSResult struct {
+	RTT float64;
+	Version string;
+	Cipher string;
+	NotAfter string;
+};
+
+func (res TLSResult) JSON() string {
+	if res.RTT < 0 {
+		return "\"None\"";
+	}
+	return fmt.Sprintf("{\"rtt\":%f,\"version\":\"%s\",\"cipher\":\"%s\",\"not_after\":\"%s\"}", res.RTT, res.Version, res.Cipher, res.NotAfter);
+}
+
+func (res TLSResult) String() string {
+	if res.RTT < 0 {
+		return "None";
+	}
+	return fmt.Sprintf("%.3f, %s, %s, %s", res.RTT, res.Version, res.Cipher, res.NotAfter);
+}
+
+/*
+	Renders a tls.Version* constant as a human-readable string, since crypto/tls doesn't
+	export one itself.
+*/
+func tlsVersionName(version uint16) string {
+	switch version {
+		case tls.VersionTLS10:
+			return "TLS 1.0";
+		case tls.VersionTLS11:
+			return "TLS 1.1";
+		case tls.VersionTLS12:
+			return "TLS 1.2";
+		case tls.VersionTLS13:
+			return "TLS 1.3";
+		default:
+			return "Unknown";
+	}
 }
 
 /*
-	Scans the ports of the host specified by "host" for http(s) and MySQL servers
-	returns a result that is the concatenation of the results of tests for each server type.
+	Connects to host on port with TLS, and reports the negotiated version/cipher along with
+	the leaf certificate's expiry. Certificate verification is disabled, since the goal here is
+	diagnostics, not trust. If anything goes wrong, it returns a TLSResult with an RTT of -1.
 */
-func Scan(host string, IPv6 bool) (utils.HttpScanResult, utils.HttpScanResult, utils.MysqlScanResult) {
+func tlsProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) TLSResult {
+	if ctx.Err() != nil {
+		return TLSResult{-1, "", "", ""};
+	}
+
+	ts := time.Now();
+	rawConn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 500 * time.Millisecond);
+	if err != nil {
+		return TLSResult{-1, "", "", ""};
+	}
+
+	if err = markConn(rawConn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on tls probe: " + err.Error());
+	}
+
+	conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true});
+	if err = conn.Handshake(); err != nil {
+		rawConn.Close();
+		return TLSResult{-1, "", "", ""};
+	}
+	defer conn.Close();
+
+	rtt := float64(time.Since(ts)) / ms;
+	state := conn.ConnectionState();
+
+	var notAfter string;
+	if len(state.PeerCertificates) > 0 {
+		notAfter = state.PeerCertificates[0].NotAfter.Format(time.RFC3339);
+	}
+
+	return TLSResult{rtt, tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), notAfter};
+}
+
+type tlsProber struct{};
+func (tlsProber) Name() string { return "tls"; }
+func (tlsProber) DefaultPort() int { return 443; }
+func (tlsProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
 	if IPv6 {
 		host = "["+host+"]";
 	}
-	var httpresult, httpsresult utils.HttpScanResult;
-	var mysqlresult utils.MysqlScanResult;
+	return tlsProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
+
+////////////////////////////////////////////////////////
+//                      DNS/53                        //
+////////////////////////////////////////////////////////
+
+/*
+	The result of probing port 53: just a TCP connect RTT, to distinguish "DNS server listens
+	on TCP" from "DNS server is unreachable" independent of the full connvitals/dns subsystem.
+*/
+type DNSPortResult struct {
+	RTT float64;
+};
+
+func (res DNSPortResult) JSON() string {
+	if res.RTT < 0 {
+		return "\"None\"";
+	}
+	return fmt.Sprintf("{\"rtt\":%f}", res.RTT);
+}
+
+func (res DNSPortResult) String() string {
+	if res.RTT < 0 {
+		return "None";
+	}
+	return fmt.Sprintf("%.3f", res.RTT);
+}
+
+/*
+	Attempts a TCP connection to host on port. Returns a DNSPortResult with an RTT of -1 on failure.
+*/
+func dnsPortProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) DNSPortResult {
+	if ctx.Err() != nil {
+		return DNSPortResult{-1};
+	}
+
+	ts := time.Now();
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 100 * time.Millisecond);
+	if err != nil {
+		return DNSPortResult{-1};
+	}
+	defer conn.Close();
+
+	if err = markConn(conn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on dns probe: " + err.Error());
+	}
+
+	return DNSPortResult{float64(time.Since(ts)) / ms};
+}
+
+type dnsProber struct{};
+func (dnsProber) Name() string { return "dns"; }
+func (dnsProber) DefaultPort() int { return 53; }
+func (dnsProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
+	if IPv6 {
+		host = "["+host+"]";
+	}
+	return dnsPortProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
+
+////////////////////////////////////////////////////////
+//                      SMTP                          //
+////////////////////////////////////////////////////////
+
+/*
+	The result of probing an SMTP server: the RTT of the connection, and its "220 ..." greeting
+	banner, followed by " | " and the first line of its EHLO response when one was read.
+*/
+type SMTPResult struct {
+	RTT float64;
+	Banner string;
+};
+
+func (res SMTPResult) JSON() string {
+	if res.RTT < 0 || res.Banner == "" {
+		return "\"None\"";
+	}
+	return fmt.Sprintf("{\"rtt\":%f,\"banner\":\"%s\"}", res.RTT, res.Banner);
+}
+
+func (res SMTPResult) String() string {
+	if res.RTT < 0 || res.Banner == "" {
+		return "None";
+	}
+	return fmt.Sprintf("%.3f, %s", res.RTT, res.Banner);
+}
+
+/*
+	Connects to host on port, reads its "220 ..." greeting, then issues an EHLO and reads
+	the first line of the response. Returns an SMTPResult with an RTT of -1 on failure.
+*/
+func smtpProbe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) SMTPResult {
+	if ctx.Err() != nil {
+		return SMTPResult{-1, ""};
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 500 * time.Millisecond);
+	if err != nil {
+		return SMTPResult{-1, ""};
+	}
+	defer conn.Close();
+
+	if err = markConn(conn, IPv6, trafficClass); err != nil {
+		utils.Warn("failed to set traffic class on smtp probe: " + err.Error());
+	}
+
+	ts := time.Now();
+	err = conn.SetDeadline(ts.Add(500 * time.Millisecond));
+	if err != nil {
+		return SMTPResult{-1, ""};
+	}
+
+	reader := bufio.NewReader(conn);
+	greeting, err := reader.ReadString('\n');
+	if err != nil {
+		return SMTPResult{-1, ""};
+	}
+
+	_, err = conn.Write([]byte("EHLO connvitals\r\n"));
+	if err != nil {
+		return SMTPResult{-1, strings.TrimRight(greeting, "\r\n")};
+	}
+
+	ehloResp, err := reader.ReadString('\n');
+	if err != nil {
+		ehloResp = "";
+	}
+
+	rtt := float64(time.Since(ts)) / ms;
+	banner := strings.TrimRight(greeting, "\r\n");
+	if ehloResp != "" {
+		banner += " | " + strings.TrimRight(ehloResp, "\r\n");
+	}
+
+	return SMTPResult{rtt, banner};
+}
+
+type smtpProber struct{};
+func (smtpProber) Name() string { return "smtp"; }
+func (smtpProber) DefaultPort() int { return 25; }
+func (smtpProber) Probe(ctx context.Context, host string, IPv6 bool, trafficClass int, port int) (Result, error) {
+	if IPv6 {
+		host = "["+host+"]";
+	}
+	return smtpProbe(ctx, host, IPv6, trafficClass, port), nil;
+}
+
+////////////////////////////////////////////////////////
+//                   Orchestration                    //
+////////////////////////////////////////////////////////
+
+/*
+	A named Result, for callers that want to print each probe's output tagged with the probe
+	that produced it.
+*/
+type NamedResult struct {
+	Name string;
+	Result Result;
+};
+
+/*
+	Splits a "--probe" list entry of the form "name" or "name:port" into its name and port. A
+	missing or unparseable port is reported as 0, telling the caller to fall back to the
+	Prober's DefaultPort().
+*/
+func parseProbeSpec(spec string) (name string, port int) {
+	name = spec;
+	if idx := strings.IndexByte(spec, ':'); idx >= 0 {
+		name = spec[:idx];
+		port, _ = strconv.Atoi(spec[idx+1:]);
+	}
+	return;
+}
+
+/*
+	Runs every Prober named in probes (as registered via Register) against host concurrently,
+	and returns their results in the same order probes was given. Each entry of probes is either
+	a bare probe name (e.g. "https"), using that Prober's DefaultPort(), or "name:port" (e.g.
+	"https:8443") to scan a non-standard port. Unrecognized probe names are not run; their
+	entry carries the name with a nil Result. If ctx is
+	already cancelled when ScanProbes is called, it returns immediately without dialing out (each
+	individual probe already bounds itself with a short timeout, so a cancellation mid-scan is
+	allowed to run to completion rather than being torn down).
+*/
+func ScanProbes(ctx context.Context, host string, IPv6 bool, probes []string, trafficClass int) []NamedResult {
+	if ctx.Err() != nil {
+		return nil;
+	}
+
+	results := make([]NamedResult, len(probes));
 	var pool sync.WaitGroup;
-	pool.Add(3);
-	go func () {
-		defer pool.Done();
-		httpresult = http(host);
-	}();
-	go func () {
-		defer pool.Done();
-		httpsresult = https(host);
-	}();
-	go func () {
-		defer pool.Done();
-		mysqlresult = mysql(host);
-	}();
+	for i, spec := range probes {
+		name, port := parseProbeSpec(spec);
+
+		prober, found := Lookup(name);
+		if !found {
+			results[i] = NamedResult{name, nil};
+			continue;
+		}
+		if port == 0 {
+			port = prober.DefaultPort();
+		}
 
+		pool.Add(1);
+		go func(i int, name string, prober Prober, port int) {
+			defer pool.Done();
+			res, _ := prober.Probe(ctx, host, IPv6, trafficClass, port);
+			results[i] = NamedResult{name, res};
+		}(i, name, prober, port);
+	}
 	pool.Wait();
 
-	return httpresult, httpsresult, mysqlresult;
+	return results;
 }
@@ -0,0 +1,146 @@
+package resolver
+
+// Copyright 2018 Comcast Cable Communications Management, LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import "net"
+import "sync"
+
+const IP4LEN = 4;
+const IP6LEN = 16;
+
+/*
+	Resolves hostnames to IP addresses. Implementations may cache answers, consult real DNS,
+	or answer from a synthetic zone for testing.
+*/
+type Resolver interface {
+	/*
+		Resolves host to an IP address, along with whether that address is IPv6. Returns an
+		error if host could not be resolved.
+	*/
+	Lookup(host string) (addr *net.IPAddr, IPv6 bool, err error);
+}
+
+/*
+	Determines whether an already-resolved IP address is IPv4 or IPv6, mirroring the logic
+	previously inlined in main.main.
+*/
+func classify(ip net.IP) (IPv6 bool, err error) {
+	if len(ip.To4()) == IP4LEN {
+		return false, nil;
+	} else if len(ip) == IP6LEN {
+		return true, nil;
+	}
+	return false, GenericError{"address '"+ip.String()+"' is neither a valid IPv4 nor IPv6 address"};
+}
+
+/*
+	Mirrors utils.GenericError so this package doesn't need to import connvitals/utils.
+*/
+type GenericError struct {
+	Msg string;
+};
+
+func (err GenericError) Error() string {
+	return err.Msg;
+}
+
+////////////////////////////////////////////////////////
+//                 Default Resolver                   //
+////////////////////////////////////////////////////////
+
+/*
+	A Resolver that wraps net.DefaultResolver, caching answers for the lifetime of the
+	CachingResolver so that identical hostnames passed multiple times in a single invocation
+	only hit the network once.
+*/
+type CachingResolver struct {
+	mtx sync.Mutex;
+	cache map[string]cacheEntry;
+};
+
+/*
+	A cached DNS answer (or the error produced trying to get one)
+*/
+type cacheEntry struct {
+	addr *net.IPAddr;
+	IPv6 bool;
+	err error;
+};
+
+/*
+	Constructs a new, empty CachingResolver.
+*/
+func NewCachingResolver() *CachingResolver {
+	return &CachingResolver{cache: make(map[string]cacheEntry)};
+}
+
+/*
+	Resolves host, consulting the cache first and populating it on a cache miss.
+*/
+func (r *CachingResolver) Lookup(host string) (addr *net.IPAddr, IPv6 bool, err error) {
+	r.mtx.Lock();
+	if entry, cached := r.cache[host]; cached {
+		r.mtx.Unlock();
+		return entry.addr, entry.IPv6, entry.err;
+	}
+	r.mtx.Unlock();
+
+	addr, err = net.ResolveIPAddr("ip", host);
+	if err == nil {
+		IPv6, err = classify(addr.IP);
+	}
+
+	r.mtx.Lock();
+	r.cache[host] = cacheEntry{addr, IPv6, err};
+	r.mtx.Unlock();
+
+	return;
+}
+
+////////////////////////////////////////////////////////
+//                  Mock Resolver                     //
+////////////////////////////////////////////////////////
+
+/*
+	A Resolver that answers from an in-memory zone instead of talking to real DNS, in the
+	spirit of foxcpp/go-mockdns. Intended for use in tests.
+*/
+type MockResolver struct {
+	zone map[string]net.IP;
+};
+
+/*
+	Constructs a MockResolver from a zone mapping hostnames to IP addresses.
+*/
+func NewMockResolver(zone map[string]net.IP) *MockResolver {
+	return &MockResolver{zone};
+}
+
+/*
+	Resolves host by looking it up in the mock zone. Returns an error if host isn't present.
+*/
+func (r *MockResolver) Lookup(host string) (addr *net.IPAddr, IPv6 bool, err error) {
+	ip, present := r.zone[host];
+	if !present {
+		return nil, false, GenericError{"host '"+host+"' not present in mock zone"};
+	}
+
+	IPv6, err = classify(ip);
+	if err != nil {
+		return nil, false, err;
+	}
+
+	return &net.IPAddr{IP: ip}, IPv6, nil;
+}
@@ -19,8 +19,118 @@ import "golang.org/x/net/icmp"
 import "time"
 import "net"
 import "golang.org/x/net/ipv6"
+import "context"
+import "math"
+import "math/bits"
+import "math/rand"
+import "encoding/binary"
 import "connvitals/utils"
 
+/*
+	Extracts any RFC 4950 MPLS Label Stack objects from a Time Exceeded or Destination
+	Unreachable response's RFC 4884 multipart ICMP extensions, flattening their labels into a
+	single slice.
+*/
+func extractMPLSLabels(extensions []icmp.Extension) []utils.MPLSLabel {
+	var labels []utils.MPLSLabel;
+	for _, ext := range extensions {
+		stack, ok := ext.(*icmp.MPLSLabelStack);
+		if !ok {
+			continue;
+		}
+		for _, label := range stack.Labels {
+			labels = append(labels, utils.MPLSLabel{label.Label, label.TC, label.S, label.TTL});
+		}
+	}
+	return labels;
+}
+
+/*
+	Extracts the identifier and sequence number of the original Echo Request embedded in a Time
+	Exceeded response's payload, so the reply can be correlated back to the probe that triggered
+	it. offset is the byte offset of the inner ICMP header within the embedded data: 20 for
+	IPv4's fixed-size header, 40 for IPv6's fixed header. ok is false if data was truncated
+	before the inner ICMP header's id/seq fields.
+*/
+func extractOriginalEcho(data []byte, offset int) (id int, seq int, ok bool) {
+	if len(data) < offset+8 {
+		return 0, 0, false;
+	}
+	id = int(data[offset+4])<<8 | int(data[offset+5]);
+	seq = int(data[offset+6])<<8 | int(data[offset+7]);
+	return id, seq, true;
+}
+
+/*
+	Extracts the original destination address and the id/seq of the original Echo Request from
+	the inner IP+ICMP header embedded in a Time Exceeded, Destination Unreachable, or Packet Too
+	Big response's payload. Used to both correlate a reply back to the probe that triggered it,
+	and (for Destination Unreachable) to recognize when the unreachable destination was our own
+	target rather than some other host sharing the path.
+*/
+func extractOriginalPacket(data []byte, IPv6 bool) (dest net.IP, id int, seq int, ok bool) {
+	offset := 20;
+	if IPv6 {
+		offset = 40;
+	}
+	if len(data) < offset {
+		return nil, 0, 0, false;
+	}
+
+	if IPv6 {
+		dest = net.IP(data[24:40]);
+	} else {
+		parts := data[16:20];
+		dest = net.IPv4(parts[0], parts[1], parts[2], parts[3]);
+	}
+
+	id, seq, ok = extractOriginalEcho(data, offset);
+	return;
+}
+
+/*
+	Maps a Destination Unreachable code to a short, human-readable reason, per RFC 792 (IPv4)
+	and RFC 4443 (IPv6) - the two code spaces overlap in meaning but not in numbering.
+*/
+func destUnreachReason(IPv6 bool, code int) string {
+	if IPv6 {
+		switch code {
+			case 0: return "no-route";
+			case 1: return "admin-prohibited";
+			case 2: return "beyond-scope";
+			case 3: return "host-unreachable";
+			case 4: return "port-unreachable";
+			case 5: return "source-policy-failed";
+			case 6: return "reject-route";
+			default: return "unreachable";
+		}
+	}
+
+	switch code {
+		case 0: return "net-unreachable";
+		case 1: return "host-unreachable";
+		case 2: return "protocol-unreachable";
+		case 3: return "port-unreachable";
+		case 4: return "fragmentation-needed";
+		case 5: return "source-route-failed";
+		case 13: return "admin-prohibited";
+		default: return "unreachable";
+	}
+}
+
+/*
+	Extracts the RFC 1191 next-hop MTU from a raw IPv4 Destination Unreachable (fragmentation
+	needed) message. The field lives in the last two bytes of the common ICMP header's 4-byte
+	"unused" field, which golang.org/x/net/icmp's DstUnreach doesn't expose since it only keeps
+	the bytes following that header.
+*/
+func ipv4FragMTU(raw []byte) (mtu int, ok bool) {
+	if len(raw) < 8 {
+		return 0, false;
+	}
+	return int(raw[6])<<8 | int(raw[7]), true;
+}
+
 const ICMP4 = 1
 const ICMP6 = 58
 
@@ -77,10 +187,13 @@ func NewConn(IPv6 bool) (conn Conn, err error) {
 
 
 /*
-	Sends a sequential ping to the host.
+	Sends a sequential ping to the host, tagged with the given ICMP identifier. Holding the
+	identifier constant across every probe of a trace (the Paris-traceroute technique) keeps
+	the packet's load-balancer hash stable across hops, so varying only seqno won't cause ECMP
+	paths to route individual probes differently.
 	Returns an error if packet construction or writing returns an error
 */
-func (conn *Conn) SendTo(seqno int, host net.IPAddr) (err error) {
+func (conn *Conn) SendTo(seqno int, id int, host net.IPAddr) (err error) {
 	var pkt []byte;
 	var psh []byte = nil;
 
@@ -89,7 +202,7 @@ func (conn *Conn) SendTo(seqno int, host net.IPAddr) (err error) {
 		psh = icmp.IPv6PseudoHeader(conn.ipv6connection.LocalAddr().(*net.IPAddr).IP, host.IP);
 	}
 
-	msg := conn.MkPacket(seqno);
+	msg := conn.MkPacket(seqno, id);
 	pkt, err = msg.Marshal(psh);
 	if err != nil {
 		return;
@@ -125,6 +238,18 @@ func (conn *Conn) SetMaxHops(n int) error {
 	return conn.ipv4connection.SetTTL(n);
 }
 
+/*
+	Sets the IPv6 Traffic Class byte, or the IPv4 TOS byte, on every packet this Conn sends,
+	without requiring the caller to know which. This lets probes measure paths for a specific
+	DSCP class (e.g. AF11, EF) instead of only best-effort.
+*/
+func (conn *Conn) SetTrafficClass(tc int) error {
+	if conn.IPv6 {
+		return conn.ipv6connection.SetTrafficClass(tc);
+	}
+	return conn.ipv4connection.SetTOS(tc);
+}
+
 /*
 	Reads data from an ipv4 or ipv6 connection into the buffer provided by buff.
 	Returns the amount of data read, the address that sent the data, and any errors raised by the read.
@@ -172,40 +297,114 @@ func (conn *Conn) Close() {
 	    Host: the ip address of the host to which the trace runs
 	    Max: Maximum number of network hops to go through before giving up
 	    Connection: A persistent network connection to the Host.
+	    Probes: number of probes sent per hop
+	    FlowID: the ICMP identifier used on every probe this Tracer sends, so that varying only
+	        the sequence number (the Paris-traceroute technique) keeps ECMP routing stable
+	        across an entire trace.
 */
 type Tracer struct {
 	Host *net.IPAddr;
 	Max int;
 	Connection Conn;
 	IPv6 bool;
+	TrafficClass int;
+	Probes int;
+	FlowID int;
+	ctx context.Context;
 };
 
 /*
-	Constructs a new Tracer object, initializing its Connection.
+	Constructs a new Tracer object, initializing its Connection. ctx, when cancelled, causes
+	Run to stop issuing further probes and to close the underlying Connection so any in-flight
+	receive unblocks promptly. trafficClass, when non-zero, is set as the IPv4 TOS/IPv6 Traffic
+	Class byte on every probe this Tracer sends. probes sets how many probes Run sends per hop
+	(classic traceroute's "-q", for aggregate per-hop statistics and ECMP-path visibility); a
+	random FlowID is chosen so concurrent Tracers on the same host don't cross-correlate replies.
 */
-func New(host *net.IPAddr, max int, IPv6 bool) (tracer *Tracer, err error) {
+func New(ctx context.Context, host *net.IPAddr, max int, IPv6 bool, trafficClass int, probes int) (tracer *Tracer, err error) {
 	conn, err := NewConn(IPv6);
 	if err != nil {
 		return;
 	}
 
+	if trafficClass != 0 {
+		if err = conn.SetTrafficClass(trafficClass); err != nil {
+			return;
+		}
+	}
+
 	tracer = &Tracer{
 		host,
 		max,
 		conn,
 		IPv6,
+		trafficClass,
+		probes,
+		rand.Intn(0xffff),
+		ctx,
 	};
 	return;
 }
 
 /*
-	Runs route tracing by sequentially sending packets with a TTL that increments from 1 to the Tracer's Max value.
-	Returns a string of results, and prints warnings to stderr if a non-timeout error occurs.
-	Returns an error if the maximum number of hops was reached without finding a route to the Host.
+	Computes min/avg/max/std over a hop's collected RTTs, in the same style as ping.PingHost
+	and dns.resolverStats. loss is the fraction (0-100) of the hop's probes that went unanswered.
+*/
+func hopStats(rtts []float64, probes int) (min, avg, max, std, loss float64) {
+	if len(rtts) == 0 {
+		return -1, -1, -1, -1, 100;
+	}
+
+	min = math.Inf(0);
+	for _, rtt := range rtts {
+		if rtt < min {
+			min = rtt;
+		}
+		if rtt > max {
+			max = rtt;
+		}
+		avg += rtt;
+	}
+	avg /= float64(len(rtts));
+
+	if len(rtts) > 1 {
+		for _, rtt := range rtts {
+			std += math.Pow(rtt-avg, 2);
+		}
+		std = math.Sqrt(std / float64(len(rtts)-1));
+	}
+
+	loss = float64(probes-len(rtts)) / float64(probes) * 100.0;
+	return;
+}
+
+/*
+	Runs route tracing by sequentially sending tracer.Probes packets per TTL, incrementing from 1
+	to the Tracer's Max value. Every probe of the trace carries the same ICMP identifier
+	(tracer.FlowID) so ECMP load-balancers hash them onto the same path (the Paris-traceroute
+	technique); only the sequence number varies, and an in-flight table keyed by that sequence
+	number (scoped to a single trace by FlowID) correlates replies back to the probe that
+	triggered them. The Echo payload built by MkPacket cancels the sequence number's own
+	contribution to the packet checksum, so ID, checksum, and the header quadruple they form
+	stay fixed too - covering load balancers that hash on the ICMP checksum instead of (or in
+	addition to) the identifier. Returns one utils.Step per hop reached, aggregating the RTTs
+	and distinct responding addresses seen at that hop, and prints warnings to stderr if a
+	non-timeout error occurs. Returns an error if the maximum number of hops was reached
+	without finding a route to the Host.
 */
 func (tracer *Tracer) Run() ([]utils.Step, error) {
 	defer tracer.Connection.Close();
 
+	done := make(chan struct{});
+	defer close(done);
+	go func() {
+		select {
+			case <-tracer.ctx.Done():
+				tracer.Connection.Close();
+			case <-done:
+		}
+	}();
+
 	// pre-allocated memory for message contents
 	buff := make([]byte, 1500);
 
@@ -213,74 +412,152 @@ func (tracer *Tracer) Run() ([]utils.Step, error) {
 	results := make([]utils.Step, tracer.Max);
 
 	// increments ttl each iteration
-	for i := 0; i < tracer.Max; i++ {
-		tracer.Connection.SetMaxHops(i+1);
-
-		// Re-set deadline for this hop
-		ts := time.Now();
-		tracer.Connection.SetDeadline(ts.Add(100*time.Millisecond));
-
-		// Send a packet
-		err := tracer.Connection.SendTo(i, *tracer.Host);
-		if err != nil {
-			results[i] = utils.Step{"*", -1};
-			utils.Warn(err.Error());
+	for hop := 0; hop < tracer.Max; hop++ {
+		if tracer.ctx.Err() != nil {
+			return results[:hop], tracer.ctx.Err();
+		}
+
+		tracer.Connection.SetMaxHops(hop+1);
+
+		// Sequence numbers are unique across the whole trace (not just this hop), so a
+		// straggling reply from an earlier hop can't be mistaken for this hop's probe.
+		sent := make(map[int]time.Time, tracer.Probes);
+		base := hop * tracer.Probes;
+		for p := 0; p < tracer.Probes; p++ {
+			seq := base + p;
+			ts := time.Now();
+			if err := tracer.Connection.SendTo(seq, tracer.FlowID, *tracer.Host); err != nil {
+				utils.Warn(err.Error());
+				continue;
+			}
+			sent[seq] = ts;
+		}
+
+		if len(sent) == 0 {
+			results[hop] = utils.Step{};
 			continue;
 		}
 
-		var rtt float64;        // stores round-trip-time in milliseconds
-		var size int;           // the amount of data received/size of the packet
-		var addr net.Addr;      // address that sent the data
-		var dest net.IP;        // original destination (used when received data implements an ICMP Time Exceeded response packet)
-		var msg *icmp.Message;  // holds the received data in the form of an ICMP packet
+		tracer.Connection.SetDeadline(time.Now().Add(100 * time.Millisecond));
 
-		// Keep receiving packets until we get a response to the packet we sent
-		for true {
+		var addrs []string;
+		var rtts []float64;
+		var mpls []utils.MPLSLabel;
+		var status string;
+		var mtu int;
+		reached := false;
 
-			// Receive a packet
-			size, addr, err = tracer.Connection.RecvFrom(buff);
+		// Keep receiving packets until every probe of this hop has either been answered or timed out
+		for len(sent) > 0 {
+			size, addr, err := tracer.Connection.RecvFrom(buff);
 			if err != nil {
-				//Likely a timeout
-				results[i] = utils.Step{"*", -1};
-				break;
+				break; // timeout
 			}
 
-			// Record the round-trip-time immediately
-			rtt = float64(time.Since(ts)) / float64(time.Millisecond);
-
-			msg, err = tracer.Connection.ICMPParse(buff[:size]);
+			msg, err := tracer.Connection.ICMPParse(buff[:size]);
 			if err != nil {
-				results[i] = utils.Step{"*", -1};
 				utils.Warn(err.Error());
-				break;
+				continue;
 			}
 
-			//Handle the different message types. Will set the 'dest' var if the type is TimeExceeded
+			var seq int;
+			var hopMPLS []utils.MPLSLabel;
+			var hopStatus string;
+			var hopMTU int;
+			var final bool;
+			var matched bool;
+
 			switch msg.Type {
 
-				// TTL/Hop_Limit Exceeded - figure out how far it got
+				// TTL/Hop_Limit Exceeded - figure out which of our probes it answers
 				case ipv6.ICMPTypeTimeExceeded:
-					dest = net.IP((*msg).Body.(*icmp.TimeExceeded).Data[24:40]);
+					timeExceeded := (*msg).Body.(*icmp.TimeExceeded);
+					hopMPLS = extractMPLSLabels(timeExceeded.Extensions);
+					var id int;
+					id, seq, matched = extractOriginalEcho(timeExceeded.Data, 40);
+					matched = matched && id == tracer.FlowID;
 				case ipv4.ICMPTypeTimeExceeded:
-					var parts []byte = (*msg).Body.(*icmp.TimeExceeded).Data[16:20];
-					dest = net.IPv4(parts[0], parts[1], parts[2], parts[3]);
+					timeExceeded := (*msg).Body.(*icmp.TimeExceeded);
+					hopMPLS = extractMPLSLabels(timeExceeded.Extensions);
+					var id int;
+					id, seq, matched = extractOriginalEcho(timeExceeded.Data, 20);
+					matched = matched && id == tracer.FlowID;
+
+				// Unreachable - figure out why, and stop the trace if it was our own target that was unreachable
+				case ipv4.ICMPTypeDestinationUnreachable:
+					fallthrough;
+				case ipv6.ICMPTypeDestinationUnreachable:
+					isV6 := msg.Type == ipv6.ICMPTypeDestinationUnreachable;
+					dstUnreach := (*msg).Body.(*icmp.DstUnreach);
+					hopMPLS = extractMPLSLabels(dstUnreach.Extensions);
+					var dest net.IP;
+					var id int;
+					dest, id, seq, matched = extractOriginalPacket(dstUnreach.Data, isV6);
+					matched = matched && id == tracer.FlowID;
+					hopStatus = destUnreachReason(isV6, msg.Code);
+					if !isV6 && msg.Code == 4 { // fragmentation needed
+						if m, ok := ipv4FragMTU(buff[:size]); ok {
+							hopMTU = m;
+						}
+					}
+					if matched && dest != nil && dest.Equal(tracer.Host.IP) {
+						final = true;
+					}
 
-				// Reply from target, figure out if it's our target and the packet was sent by a tracer
+				// Next-hop MTU is too small for the probe we sent; report it as a path-MTU signal.
+				// Packet Too Big doesn't carry RFC 4884 multipart extensions, unlike Time
+				// Exceeded and Destination Unreachable.
+				case ipv6.ICMPTypePacketTooBig:
+					packetTooBig := (*msg).Body.(*icmp.PacketTooBig);
+					var id int;
+					id, seq, matched = extractOriginalEcho(packetTooBig.Data, 40);
+					matched = matched && id == tracer.FlowID;
+					hopStatus = "packet-too-big";
+					hopMTU = packetTooBig.MTU;
+
+				// Reply from target, figure out if it's our target and the packet was sent by this tracer
 				case ipv4.ICMPTypeEchoReply:
 					fallthrough;
 				case ipv6.ICMPTypeEchoReply:
-					if addr.(*net.IPAddr).IP.Equal(tracer.Host.IP) && msg.Body.(*icmp.Echo).ID == 1 {
-						results[i] = utils.Step{addr.String(), rtt};
-						return results[:i+1], nil;
+					echo := msg.Body.(*icmp.Echo);
+					if echo.ID == tracer.FlowID {
+						seq = echo.Seq;
+						matched = true;
+						final = addr.(*net.IPAddr).IP.Equal(tracer.Host.IP);
 					}
 			}
 
-			// If the packet was a Time Exceeded message, check if it was sent by our tracer. If yes, record result and move on.
-			if dest.Equal(tracer.Host.IP) {
-				results[i] = utils.Step{addr.String(), rtt};
-				break;
+			if !matched {
+				continue;
+			}
+
+			sentTime, wasSent := sent[seq];
+			if !wasSent {
+				continue;
 			}
+			delete(sent, seq);
 
+			addrs = append(addrs, addr.String());
+			rtts = append(rtts, float64(time.Since(sentTime))/float64(time.Millisecond));
+			if len(hopMPLS) > 0 {
+				mpls = append(mpls, hopMPLS...);
+			}
+			if hopStatus != "" {
+				status = hopStatus;
+			}
+			if hopMTU != 0 {
+				mtu = hopMTU;
+			}
+			if final {
+				reached = true;
+			}
+		}
+
+		min, avg, max, std, loss := hopStats(rtts, tracer.Probes);
+		results[hop] = utils.Step{addrs, rtts, min, avg, max, std, loss, mpls, status, mtu};
+
+		if reached {
+			return results[:hop+1], nil;
 		}
 	}
 
@@ -291,9 +568,11 @@ func (tracer *Tracer) Run() ([]utils.Step, error) {
 
 
 /*
-	Constructs an icmp packet to send along a connection
+	Constructs an icmp packet to send along a connection. The payload is chosen by
+	checksumPad so that Seq can vary from probe to probe without perturbing the packet's
+	checksum, keeping Type, Code, Checksum and ID fixed across a trace.
 */
-func (conn *Conn) MkPacket(seqno int) (msg icmp.Message) {
+func (conn *Conn) MkPacket(seqno int, id int) (msg icmp.Message) {
 	var typ icmp.Type;
 	if conn.IPv6 {
 		typ = ipv6.ICMPTypeEchoRequest;
@@ -305,10 +584,27 @@ func (conn *Conn) MkPacket(seqno int) (msg icmp.Message) {
 		Type: typ,
 		Code: 0,
 		Body: &icmp.Echo{
-			ID: 1,
+			ID: id,
 			Seq: seqno,
-			Data: make([]byte, 1),
+			Data: checksumPad(seqno),
 		},
 	};
 	return;
 }
+
+/*
+	Returns the 2-byte Echo payload that offsets seqno's own contribution to the packet's
+	ones'-complement checksum, so that varying Seq across probes doesn't vary the resulting
+	Checksum field (some ECMP implementations hash on the ICMP checksum as a stand-in for an
+	L4 port when there's no real port to hash on). This is the RFC 1624 incremental-checksum
+	trick: complementing a word exactly cancels its contribution to a ones'-complement sum, so
+	the byte-swapped complement of seqno (byte-swapped because golang.org/x/net/icmp's
+	checksum routine reads 16-bit words in that order) offsets Seq's change from its baseline
+	of 0 in the all-zero packet. A word plus its complement always sums to 0xffff (ones'-
+	complement zero), so the Checksum is the same for every seqno.
+*/
+func checksumPad(seqno int) []byte {
+	pad := make([]byte, 2);
+	binary.LittleEndian.PutUint16(pad, ^bits.ReverseBytes16(uint16(seqno)));
+	return pad;
+}
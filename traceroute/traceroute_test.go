@@ -0,0 +1,179 @@
+package traceroute
+
+// Copyright 2018 Comcast Cable Communications Management, LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import "testing"
+import "net"
+import "golang.org/x/net/ipv4"
+import "golang.org/x/net/icmp"
+import "connvitals/utils"
+
+/*
+	Confirms checksumPad does what MkPacket relies on it for: packets that differ only in Seq
+	(same Type, Code and ID) marshal to the same on-wire Checksum, so ECMP implementations that
+	hash on the ICMP checksum see a stable flow across every probe of a trace.
+*/
+func TestChecksumPadKeepsChecksumStable(t *testing.T) {
+	var baseline int;
+	for i, seqno := range []int{0, 1, 2, 255, 256, 4000, 65535} {
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Code: 0,
+			Body: &icmp.Echo{
+				ID: 1234,
+				Seq: seqno,
+				Data: checksumPad(seqno),
+			},
+		};
+
+		pkt, err := msg.Marshal(nil);
+		if err != nil {
+			t.Fatalf("Marshal(seqno=%d) failed: %s", seqno, err);
+		}
+
+		checksum := int(pkt[2])<<8 | int(pkt[3]);
+		if i == 0 {
+			baseline = checksum;
+			continue;
+		}
+		if checksum != baseline {
+			t.Errorf("checksum for seqno=%d was %#04x, want %#04x (same as seqno=0)", seqno, checksum, baseline);
+		}
+	}
+}
+
+/*
+	Confirms extractMPLSLabels flattens labels out of the MPLSLabelStack extensions in a
+	response and ignores extensions of other types.
+*/
+func TestExtractMPLSLabels(t *testing.T) {
+	extensions := []icmp.Extension{
+		&icmp.InterfaceInfo{},
+		&icmp.MPLSLabelStack{
+			Labels: []icmp.MPLSLabel{
+				{Label: 16014, TC: 0x4, S: true, TTL: 255},
+				{Label: 16013, TC: 0x7, S: false, TTL: 254},
+			},
+		},
+	};
+
+	got := extractMPLSLabels(extensions);
+	want := []utils.MPLSLabel{
+		{16014, 0x4, true, 255},
+		{16013, 0x7, false, 254},
+	};
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d labels, want %d: %+v", len(got), len(want), got);
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("label %d: got %+v, want %+v", i, got[i], want[i]);
+		}
+	}
+}
+
+/*
+	Builds a fake embedded IP+ICMP header, as would be found in the payload of a Time
+	Exceeded/Destination Unreachable/Packet Too Big response, with the given destination
+	address and Echo id/seq.
+*/
+func fakeEmbeddedPacket(IPv6 bool, dest net.IP, id, seq int) []byte {
+	offset := 20;
+	if IPv6 {
+		offset = 40;
+	}
+	data := make([]byte, offset+8);
+
+	if IPv6 {
+		copy(data[24:40], dest.To16());
+	} else {
+		copy(data[16:20], dest.To4());
+	}
+
+	data[offset+4] = byte(id >> 8);
+	data[offset+5] = byte(id);
+	data[offset+6] = byte(seq >> 8);
+	data[offset+7] = byte(seq);
+	return data;
+}
+
+/*
+	Confirms extractOriginalPacket recovers the embedded destination address and Echo id/seq
+	for both IPv4 and IPv6, and reports !ok when the payload was truncated before the inner
+	header's id/seq fields.
+*/
+func TestExtractOriginalPacket(t *testing.T) {
+	ipv4Dest := net.ParseIP("203.0.113.7").To4();
+	dest, id, seq, ok := extractOriginalPacket(fakeEmbeddedPacket(false, ipv4Dest, 1234, 5), false);
+	if !ok || !dest.Equal(ipv4Dest) || id != 1234 || seq != 5 {
+		t.Errorf("ipv4: got dest=%v id=%d seq=%d ok=%v, want dest=%v id=1234 seq=5 ok=true", dest, id, seq, ok, ipv4Dest);
+	}
+
+	ipv6Dest := net.ParseIP("2001:db8::7");
+	dest, id, seq, ok = extractOriginalPacket(fakeEmbeddedPacket(true, ipv6Dest, 4321, 9), true);
+	if !ok || !dest.Equal(ipv6Dest) || id != 4321 || seq != 9 {
+		t.Errorf("ipv6: got dest=%v id=%d seq=%d ok=%v, want dest=%v id=4321 seq=9 ok=true", dest, id, seq, ok, ipv6Dest);
+	}
+
+	if _, _, _, ok := extractOriginalPacket(make([]byte, 10), false); ok {
+		t.Errorf("expected !ok for a payload truncated before the inner header's id/seq fields");
+	}
+}
+
+/*
+	Confirms destUnreachReason maps a representative sample of codes to the right reason for
+	both IPv4 and IPv6, falling back to a generic reason for unrecognized codes.
+*/
+func TestDestUnreachReason(t *testing.T) {
+	cases := []struct {
+		IPv6 bool;
+		code int;
+		want string;
+	}{
+		{false, 3, "port-unreachable"},
+		{false, 4, "fragmentation-needed"},
+		{false, 99, "unreachable"},
+		{true, 3, "host-unreachable"},
+		{true, 4, "port-unreachable"},
+		{true, 99, "unreachable"},
+	};
+
+	for _, c := range cases {
+		if got := destUnreachReason(c.IPv6, c.code); got != c.want {
+			t.Errorf("destUnreachReason(IPv6=%v, code=%d) = %q, want %q", c.IPv6, c.code, got, c.want);
+		}
+	}
+}
+
+/*
+	Confirms ipv4FragMTU reads the RFC 1191 next-hop MTU out of the last two bytes of the
+	common ICMP header's "unused" field, and reports !ok when the message was too short to
+	contain it.
+*/
+func TestIpv4FragMTU(t *testing.T) {
+	raw := make([]byte, 8);
+	raw[6] = 0x05;
+	raw[7] = 0xdc; // 1500
+
+	mtu, ok := ipv4FragMTU(raw);
+	if !ok || mtu != 1500 {
+		t.Errorf("got mtu=%d ok=%v, want mtu=1500 ok=true", mtu, ok);
+	}
+
+	if _, ok := ipv4FragMTU(make([]byte, 4)); ok {
+		t.Errorf("expected !ok for a message too short to contain the MTU field");
+	}
+}
@@ -22,99 +22,219 @@ import "net"
 import "syscall"
 import "unsafe"
 import "runtime"
+import "encoding/json"
 
 ////////////////////////////////////////////////////////
 //                Route Trace Objects                 //
 ////////////////////////////////////////////////////////
 
 /*
-	A type that holds information about a specific step in a route trace
+	A single RFC 4950 MPLS label, as found in the label stack of an RFC 4884 multipart ICMP
+	extension object attached to a Time Exceeded or Destination Unreachable response.
+*/
+type MPLSLabel struct {
+	Label int;
+	TC int;
+	S bool;
+	TTL int;
+};
+
+/*
+	Returns an MPLSLabel object's representation in JSON format
+*/
+func (label MPLSLabel) JSON() string {
+	return fmt.Sprintf("{\"label\":%d,\"tc\":%d,\"s\":%t,\"ttl\":%d}", label.Label, label.TC, label.S, label.TTL);
+}
+
+/*
+	Returns an MPLSLabel object's representation as a comma-separated list
+*/
+func (label MPLSLabel) String() string {
+	return fmt.Sprintf("%d,%d,%t,%d", label.Label, label.TC, label.S, label.TTL);
+}
+
+/*
+	A type that holds information about a specific hop in a route trace, aggregated over the
+	(possibly several) probes sent at that hop's TTL. Addrs holds up to one address per
+	responding probe (in the order replies were received), and RTTs holds the round-trip-time
+	of each corresponding response; Min/Avg/Max/Std/Loss summarize RTTs the same way ping and
+	DNS diagnostics summarize their own samples. MPLS is populated from any RFC 4950 MPLS Label
+	Stack objects present on the hop's Time Exceeded or Destination Unreachable responses, and
+	is nil if none carried one.
+	Status carries a short reason code ("net-unreachable", "port-unreachable",
+	"packet-too-big", etc.) when the hop answered with something other than a plain Time
+	Exceeded or Echo Reply, and is empty otherwise. MTU is the next-hop MTU reported by a
+	Packet Too Big / fragmentation-needed response, or 0 if none was reported.
 */
 type Step struct {
-	Host string;
-	RTT float64;
+	Addrs []string;
+	RTTs []float64;
+	Min float64;
+	Avg float64;
+	Max float64;
+	Std float64;
+	Loss float64;
+	MPLS []MPLSLabel;
+	Status string;
+	MTU int;
 };
 
 /*
 	Returns a Step object's representation in JSON format
 */
 func (step Step) JSON() string {
-	if step.RTT < 0 || step.Host == "*" {
+	if len(step.Addrs) == 0 {
 		return "[\"*\"]";
 	}
-	return fmt.Sprintf("[\"%s\", %f]", step.Host, step.RTT);
+
+	var rtts bytes.Buffer;
+	rtts.WriteRune('[');
+	for i, rtt := range step.RTTs {
+		if i > 0 {
+			rtts.WriteRune(',');
+		}
+		rtts.WriteString(fmt.Sprintf("%f", rtt));
+	}
+	rtts.WriteRune(']');
+
+	var mpls bytes.Buffer;
+	mpls.WriteRune('[');
+	for i, label := range step.MPLS {
+		if i > 0 {
+			mpls.WriteRune(',');
+		}
+		mpls.WriteString(label.JSON());
+	}
+	mpls.WriteRune(']');
+
+	return fmt.Sprintf(
+		"{\"addrs\":%s,\"rtts\":%s,\"min\":%f,\"avg\":%f,\"max\":%f,\"std\":%f,\"loss\":%f,\"mpls\":%s,\"status\":\"%s\",\"mtu\":%d}",
+		jsonStringArray(step.Addrs), rtts.String(), step.Min, step.Avg, step.Max, step.Std, step.Loss, mpls.String(), step.Status, step.MTU,
+	);
 }
 
 /*
 	Returns a Step objects representation as a tab-separated list
 */
 func (step Step) String() string {
-	if step.RTT < 0 || step.Host == "*" {
+	if len(step.Addrs) == 0 {
 		return "*";
 	}
-	return fmt.Sprintf("%s\t%.3f", step.Host, step.RTT);
+
+	var addrs bytes.Buffer;
+	for i, addr := range step.Addrs {
+		if i > 0 {
+			addrs.WriteRune(';');
+		}
+		addrs.WriteString(addr);
+	}
+
+	out := fmt.Sprintf("%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f", addrs.String(), step.Min, step.Avg, step.Max, step.Std, step.Loss);
+	if step.Status != "" {
+		out += "\t" + step.Status;
+		if step.MTU != 0 {
+			out += fmt.Sprintf("(mtu=%d)", step.MTU);
+		}
+	}
+	if len(step.MPLS) == 0 {
+		return out;
+	}
+
+	var mpls bytes.Buffer;
+	mpls.WriteString("\tMPLS(");
+	for i, label := range step.MPLS {
+		if i > 0 {
+			mpls.WriteRune(';');
+		}
+		mpls.WriteString(label.String());
+	}
+	mpls.WriteRune(')');
+
+	return out + mpls.String();
 }
 
 
 ////////////////////////////////////////////////////////
-//                 Port Scan Objects                  //
+//                  DNS Diagnostics                   //
 ////////////////////////////////////////////////////////
 
 /*
-	A type that represents the information gathered during an http(s) port scan
+	A type that represents the information gathered during a DNS diagnostic query
+	against a single host: the records retrieved, resolver RTT statistics (min/avg/max/std/loss)
+	over the queries used to gather them, and a TCP-vs-UDP timing comparison.
 */
-type HttpScanResult struct {
-	RTT float64;
-	Response string;
-	Server string;
+type DNSResult struct {
+	A []string;
+	AAAA []string;
+	CNAME []string;
+	MX []string;
+	TXT []string;
+	NS []string;
+	Min float64;
+	Avg float64;
+	Max float64;
+	Std float64;
+	Loss float64;
+	TCPRTT float64;
+	UDPRTT float64;
 };
 
 /*
-	Returns an HttpScanResult object's representation in JSON format
+	Joins a slice of strings with commas, or returns "None" if the slice is empty
 */
-func (res HttpScanResult) JSON() string {
-	if res.RTT < 0 || (res.Response == "" && res.Server == "") {
-		return "\"None\"";
+func joinOrNone(vals []string) string {
+	if len(vals) == 0 {
+		return "None";
+	}
+	var buffer bytes.Buffer;
+	for i, val := range vals {
+		if i > 0 {
+			buffer.WriteRune(',');
+		}
+		buffer.WriteString(val);
 	}
-	return fmt.Sprintf("{\"rtt\":%f,\"response code\":\"%s\",\"server\":\"%s\"}", res.RTT, res.Response, res.Server);
+	return buffer.String();
 }
 
 /*
-	Returns an HttpScanResult object's representation as a delimited list
+	Renders a slice of strings as a JSON array of quoted strings, escaping each value (DNS
+	answers - TXT/SPF/DKIM records in particular - can legitimately contain quotes and
+	backslashes) so the result is always valid JSON.
 */
-func (res HttpScanResult) String() string {
-	if res.RTT < 0 || (res.Response == "" && res.Server == "") {
-		return "None";
+func jsonStringArray(vals []string) string {
+	var buffer bytes.Buffer;
+	buffer.WriteRune('[');
+	for i, val := range vals {
+		if i > 0 {
+			buffer.WriteRune(',');
+		}
+		encoded, _ := json.Marshal(val);
+		buffer.Write(encoded);
 	}
-	return fmt.Sprintf("%.3f, %s, %s", res.RTT, res.Response, res.Server);
+	buffer.WriteRune(']');
+	return buffer.String();
 }
 
 /*
-	A type that represents the information gathered during a mysql port scan
+	Returns a DNSResult object's representation in JSON format
 */
-type MysqlScanResult struct {
-	RTT float64;
-	Version string;
-};
-
-/*
-	Returns the JSON representation of a MysqlScanResult object
-*/
-func (res MysqlScanResult) JSON() string {
-	if res.RTT < 0 || res.Version == "" {
-		return "\"None\"";
-	}
-	return fmt.Sprintf("{\"rtt\":%f,\"version\":\"%s\"}", res.RTT, res.Version);
+func (res DNSResult) JSON() string {
+	return fmt.Sprintf(
+		"{\"a\":%s,\"aaaa\":%s,\"cname\":%s,\"mx\":%s,\"txt\":%s,\"ns\":%s,\"min\":%f,\"avg\":%f,\"max\":%f,\"std\":%f,\"loss\":%f,\"tcp_rtt\":%f,\"udp_rtt\":%f}",
+		jsonStringArray(res.A), jsonStringArray(res.AAAA), jsonStringArray(res.CNAME), jsonStringArray(res.MX), jsonStringArray(res.TXT), jsonStringArray(res.NS),
+		res.Min, res.Avg, res.Max, res.Std, res.Loss, res.TCPRTT, res.UDPRTT,
+	);
 }
 
 /*
-	Returns the delimited, string representation of a MysqlScanResult object
+	Returns a DNSResult object's representation as a tab-separated list
 */
-func (res MysqlScanResult) String() string {
-	if res.RTT < 0 || res.Version == "" {
-		return "None";
-	}
-	return fmt.Sprintf("%.3f, %s", res.RTT, res.Version);
+func (res DNSResult) String() string {
+	return fmt.Sprintf(
+		"%s\t%s\t%s\t%s\t%s\t%s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f",
+		joinOrNone(res.A), joinOrNone(res.AAAA), joinOrNone(res.CNAME), joinOrNone(res.MX), joinOrNone(res.TXT), joinOrNone(res.NS),
+		res.Min, res.Avg, res.Max, res.Std, res.Loss, res.TCPRTT, res.UDPRTT,
+	);
 }
 
 
@@ -125,13 +245,13 @@ func (res MysqlScanResult) String() string {
 /*
 	Prints results, in either JSON or plaintext format, as specified by `json`
 */
-func Print(json bool, hostnames, pingResults, traceResults, scanResults map[*net.IPAddr]string) {
+func Print(json bool, hostnames, pingResults, traceResults, scanResults, dnsResults map[*net.IPAddr]string) {
 	var output_buffer bytes.Buffer;
 
 	if json {
 		for addr, name := range hostnames {
 			output_buffer.WriteString("{\"addr\":\"");
-			var wrotePings, wroteRoutes bool;
+			var wrotePings, wroteRoutes, wroteScans bool;
 			output_buffer.WriteString(addr.String());
 			output_buffer.WriteString("\",\"name\":\"");
 			output_buffer.WriteString(name);
@@ -157,6 +277,15 @@ func Print(json bool, hostnames, pingResults, traceResults, scanResults map[*net
 				}
 				output_buffer.WriteString("\"scan\":");
 				output_buffer.WriteString(scanResult);
+				wroteScans = true;
+			}
+
+			if dnsResult, resultsRecorded := dnsResults[addr]; resultsRecorded {
+				if wrotePings || wroteRoutes || wroteScans {
+					output_buffer.WriteRune(',');
+				}
+				output_buffer.WriteString("\"dns\":");
+				output_buffer.WriteString(dnsResult);
 			}
 			output_buffer.WriteRune('}');
 			fmt.Println(output_buffer.String());
@@ -180,6 +309,9 @@ func Print(json bool, hostnames, pingResults, traceResults, scanResults map[*net
 			if scanResult, resultsRecorded := scanResults[addr]; resultsRecorded {
 				fmt.Println(scanResult);
 			}
+			if dnsResult, resultsRecorded := dnsResults[addr]; resultsRecorded {
+				fmt.Println(dnsResult);
+			}
 		}
 	}
 }
@@ -0,0 +1,53 @@
+package utils
+
+// Copyright 2018 Comcast Cable Communications Management, LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import "encoding/json"
+import "strings"
+import "testing"
+
+/*
+	Confirms DNSResult.String()'s trailing columns line up with the order the format string
+	declares (..., TXT, NS), not swapped.
+*/
+func TestDNSResultStringColumnOrder(t *testing.T) {
+	res := DNSResult{TXT: []string{"v=spf1 include:example.com ~all"}, NS: []string{"ns1.example.com"}};
+	fields := strings.Split(res.String(), "\t");
+
+	if fields[4] != "v=spf1 include:example.com ~all" {
+		t.Errorf("expected TXT in column 4, got %q", fields[4]);
+	}
+	if fields[5] != "ns1.example.com" {
+		t.Errorf("expected NS in column 5, got %q", fields[5]);
+	}
+}
+
+/*
+	Confirms DNSResult.JSON() escapes DNS-sourced strings (TXT/CNAME/MX/NS answers can
+	legitimately contain quotes or backslashes, e.g. SPF/DKIM records) into valid JSON.
+*/
+func TestDNSResultJSONEscapesStrings(t *testing.T) {
+	res := DNSResult{TXT: []string{`v=spf1 "include" a\b ~all`}};
+
+	var decoded map[string]interface{};
+	if err := json.Unmarshal([]byte(res.JSON()), &decoded); err != nil {
+		t.Fatalf("DNSResult.JSON() produced invalid JSON: %s", err);
+	}
+
+	txt, ok := decoded["txt"].([]interface{});
+	if !ok || len(txt) != 1 || txt[0] != `v=spf1 "include" a\b ~all` {
+		t.Errorf("expected txt field to round-trip the original string, got %v", decoded["txt"]);
+	}
+}